@@ -0,0 +1,227 @@
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	dto "github.com/prometheus/client_model/go"
+	"google.golang.org/protobuf/proto"
+
+	"github.com/insikl/prometheus-nats-ambassador/internal/logger"
+)
+
+// One scrape per host instead of one per exporter. Requests on `-aggsubj` are
+// answered with the merged exposition of every route of this ambassador, each
+// series gets a label naming the exporter it came from. Wildcard routes are
+// left out as they need a subject to resolve.
+var (
+	aggregateSubject = ""
+	aggregateLabel   = "exporter"
+)
+
+// Subscription metadata key for the exporter label value, defaults to the
+// `pubsubname`
+const metadataExporter = "exporter"
+
+// Synthetic metric with the result of each exporter in an aggregate scrape
+const aggregateSuccessMetric = "natsambassador_aggregate_scrape_success"
+
+// Exporter label value for a route
+func (route *exporterRoute) exporterName() string {
+	if name := route.sub.Metadata[metadataExporter]; name != "" {
+		return name
+	}
+	if route.sub.PubSubName != "" {
+		return route.sub.PubSubName
+	}
+	return route.sub.Topic
+}
+
+// Check the routes on the aggregate subject each have their own exporter name,
+// series of routes sharing one could not be told apart
+func checkAggregateNames(routes map[string]*exporterRoute) error {
+	var topics []string
+	for topic, route := range routes {
+		if !route.wildcard() {
+			topics = append(topics, topic)
+		}
+	}
+	sort.Strings(topics)
+
+	seen := make(map[string]string, len(topics))
+	for _, topic := range topics {
+		name := routes[topic].exporterName()
+		if other, ok := seen[name]; ok {
+			return fmt.Errorf("-aggsubj routes [%v] and [%v] both have exporter %q, set metadata %q",
+				other, topic, name, metadataExporter)
+		}
+		seen[name] = topic
+	}
+	return nil
+}
+
+// Result of fetching one route for an aggregate scrape
+type aggregatePart struct {
+	exporter string
+	families []*dto.MetricFamily
+	err      error
+}
+
+// Fetch a route for an aggregate scrape, through the same route rules,
+// health check and relabeling as a request on its own subject
+func fetchAggregatePart(route *exporterRoute, params url.Values, reqHeader http.Header) ([]*dto.MetricFamily, error) {
+	endpoint, err := route.resolve(routeRequest{
+		Subject: route.sub.Topic,
+		Query:   params,
+		Header:  reqHeader,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := route.health.failFast(endpoint); err != nil {
+		return nil, err
+	}
+
+	// Ask for something we can parse and keep it in that format after
+	// relabeling, the merged result is encoded once at the end
+	accept := parseableAccept(reqHeader.Get("Accept"))
+	fetchHeader := reqHeader.Clone()
+	fetchHeader.Set("Accept", accept)
+
+	reply, err := ProxyPrometheusRequest(route.sub.Topic, endpoint, params.Encode(), fetchHeader, route)
+	if err != nil {
+		return nil, err
+	}
+	if route.relabel != nil {
+		if err := route.relabel.apply(route.sub.Topic, reply, accept); err != nil {
+			return nil, err
+		}
+	}
+	return decodeFamilies(reply)
+}
+
+// Merge the parts into families by name, adding the exporter label. A family
+// with the same name but a different type from another exporter is skipped.
+func mergeAggregate(parts []aggregatePart) map[string]*dto.MetricFamily {
+	families := make(map[string]*dto.MetricFamily)
+	success := &dto.MetricFamily{
+		Name: proto.String(aggregateSuccessMetric),
+		Help: proto.String("Whether fetching the exporter in an aggregate scrape succeeded"),
+		Type: dto.MetricType_GAUGE.Enum(),
+	}
+
+	for _, part := range parts {
+		value := 1.0
+		if part.err != nil {
+			value = 0
+		}
+		success.Metric = append(success.Metric, &dto.Metric{
+			Label: []*dto.LabelPair{{
+				Name:  proto.String(aggregateLabel),
+				Value: proto.String(part.exporter),
+			}},
+			Gauge: &dto.Gauge{Value: proto.Float64(value)},
+		})
+
+		for _, mf := range part.families {
+			out, ok := families[mf.GetName()]
+			if !ok {
+				out = &dto.MetricFamily{Name: mf.Name, Help: mf.Help, Type: mf.Type, Unit: mf.Unit}
+				families[mf.GetName()] = out
+			} else if out.GetType() != mf.GetType() {
+				logger.Warn("Aggregate skipping %v from [%v], type %v does not match %v",
+					mf.GetName(), part.exporter, mf.GetType(), out.GetType())
+				continue
+			}
+
+			for _, m := range mf.GetMetric() {
+				labels := make(map[string]string, len(m.GetLabel())+1)
+				for _, lp := range m.GetLabel() {
+					labels[lp.GetName()] = lp.GetValue()
+				}
+				// Same as Prometheus with `honor_labels: false`
+				if v, ok := labels[aggregateLabel]; ok {
+					labels["exported_"+aggregateLabel] = v
+				}
+				labels[aggregateLabel] = part.exporter
+				setLabels(m, labels)
+				out.Metric = append(out.Metric, m)
+			}
+		}
+	}
+	families[aggregateSuccessMetric] = success
+	return families
+}
+
+// NATS handler for the aggregate subject
+func (pubsub *ProxyConn) AggregateRequestHandler(msg *nats.Msg) {
+	start := time.Now()
+	reqHeader := http.Header(msg.Header)
+	if reqHeader == nil {
+		reqHeader = http.Header{}
+	}
+	params, _ := url.ParseQuery(string(msg.Data))
+
+	var routes []*exporterRoute
+	for _, route := range topicMap {
+		if !route.wildcard() {
+			routes = append(routes, route)
+		}
+	}
+	sort.Slice(routes, func(i, j int) bool {
+		return routes[i].sub.Topic < routes[j].sub.Topic
+	})
+
+	parts := make([]aggregatePart, len(routes))
+	var wg sync.WaitGroup
+	for i, route := range routes {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			families, err := fetchAggregatePart(route, params, reqHeader)
+			if err != nil {
+				logger.Error("Aggregate fetch of [%v] failed: %v", route.sub.Topic, err)
+			}
+			parts[i] = aggregatePart{exporter: route.exporterName(), families: families, err: err}
+		}()
+	}
+	wg.Wait()
+
+	var reply *exporterReply
+	body, format, err := encodeFamilies(mergeAggregate(parts), reqHeader.Get("Accept"))
+	if err != nil {
+		reply, err = errorReply(msg.Subject, http.StatusInternalServerError, err)
+	} else {
+		reply, err = localReply(msg.Subject, body)
+		reply.Header.Set("Content-Type", string(format))
+	}
+
+	if err == nil {
+		err = compressReply(reply, reqHeader.Get(hdrAcceptEncoding))
+		if err != nil {
+			reply, err = errorReply(msg.Subject, http.StatusBadGateway, err)
+		}
+	}
+	if showDebug {
+		logger.Debug("aggregate of %d routes on [%v] in %v", len(routes), msg.Subject, time.Since(start))
+	}
+	if err := pubsub.RespondReply(msg, newReplyMsg(reply, err)); err != nil {
+		logger.Error("Error sending reply on [%v]: %v", msg.Subject, err)
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/insikl/prometheus-nats-ambassador/internal/models"
+)
+
+// Test families from several exporters are merged with an exporter label
+func TestMergeAggregate(t *testing.T) {
+	parse := func(body string) *exporterReply {
+		hdr := http.Header{}
+		hdr.Set("Content-Type", "text/plain; version=0.0.4")
+		return &exporterReply{Status: http.StatusOK, Header: hdr, Body: []byte(body)}
+	}
+	node, err := decodeFamilies(parse("# TYPE up gauge\nup 1\n# TYPE process_open_fds gauge\nprocess_open_fds 7\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pg, err := decodeFamilies(parse("# TYPE up gauge\nup{exporter=\"pg\"} 1\n# TYPE process_open_fds counter\nprocess_open_fds 3\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	families := mergeAggregate([]aggregatePart{
+		{exporter: "node", families: node},
+		{exporter: "postgres", families: pg},
+		{exporter: "mysql", err: errors.New("down")},
+	})
+	body, _, err := encodeFamilies(families, "text/plain")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, want := range []string{
+		`up{exporter="node"} 1`,
+		`up{exported_exporter="pg",exporter="postgres"} 1`,
+		`process_open_fds{exporter="node"} 7`,
+		`natsambassador_aggregate_scrape_success{exporter="mysql"} 0`,
+		`natsambassador_aggregate_scrape_success{exporter="postgres"} 1`,
+	} {
+		if !strings.Contains(string(body), want+"\n") {
+			t.Errorf("missing %q in:\n%s", want, body)
+		}
+	}
+	// Conflicting type is skipped rather than breaking the exposition
+	if strings.Contains(string(body), `process_open_fds{exporter="postgres"}`) {
+		t.Errorf("expected conflicting family to be skipped:\n%s", body)
+	}
+}
+
+// Test routes sharing an exporter name on the aggregate subject are rejected
+func TestCheckAggregateNames(t *testing.T) {
+	routes := func(subs ...models.Subscription) map[string]*exporterRoute {
+		m := make(map[string]*exporterRoute)
+		for _, sub := range subs {
+			m[sub.Topic] = &exporterRoute{sub: sub}
+		}
+		return m
+	}
+
+	ok := routes(
+		models.Subscription{PubSubName: "node_exporter", Topic: "host1.node"},
+		models.Subscription{PubSubName: "node_exporter", Topic: "host1.node2", Metadata: map[string]string{metadataExporter: "node2"}},
+		models.Subscription{PubSubName: "node_exporter", Topic: "host1.*"},
+		models.Subscription{Topic: "host1.postgres"},
+	)
+	if err := checkAggregateNames(ok); err != nil {
+		t.Error(err)
+	}
+
+	dup := routes(
+		models.Subscription{PubSubName: "node_exporter", Topic: "host1.node"},
+		models.Subscription{PubSubName: "node_exporter", Topic: "host1.node2"},
+	)
+	if err := checkAggregateNames(dup); err == nil {
+		t.Errorf("expected error for shared pubsubname")
+	}
+
+	dup = routes(
+		models.Subscription{Topic: "host1.a", Metadata: map[string]string{metadataExporter: "host1.b"}},
+		models.Subscription{Topic: "host1.b"},
+	)
+	if err := checkAggregateNames(dup); err == nil {
+		t.Errorf("expected error for exporter matching a topic")
+	}
+}
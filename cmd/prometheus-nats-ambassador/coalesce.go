@@ -0,0 +1,106 @@
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+// Several Prometheus servers scraping the same target through one scraper side
+// ambassador at about the same time only need one NATS request. A scrape with
+// the same subject, params, path, `Accept` and `Accept-Encoding` as one that
+// started less than `-coalesce` ago waits for that reply instead of sending
+// its own. Off by default.
+var scrapeCoalesce time.Duration
+
+type scrapeCall struct {
+	done    chan struct{}
+	started time.Time
+	msg     *nats.Msg
+	err     error
+}
+
+var (
+	scrapeCallsMu sync.Mutex
+	scrapeCalls   = make(map[string]*scrapeCall)
+	// Called when a scrape joins a call in flight, for tests
+	scrapeJoined func()
+)
+
+// Key for identical scrapes, `params` is the encoded query without the scrape
+// timeout. Other headers such as `User-Agent` are left out so Prometheus
+// servers on different versions still share a request.
+func coalesceKey(subj, path, params, accept, acceptEncoding string) string {
+	return strings.Join([]string{subj, path, params, accept, acceptEncoding}, "\n")
+}
+
+// Call fetch or join a call in flight with the same key. Returns true when
+// the reply came from another caller's fetch. The reply message is shared,
+// callers must not modify it.
+//
+// A joining caller waits no longer than its own `timeout`. When the call it
+// joined timed out first, it sends its own request for the time it has left.
+func coalescedRequest(
+	ctx context.Context,
+	key string,
+	timeout time.Duration,
+	fetch func(timeout time.Duration) (*nats.Msg, error),
+) (*nats.Msg, bool, error) {
+	if scrapeCoalesce <= 0 {
+		msg, err := fetch(timeout)
+		return msg, false, err
+	}
+
+	deadline := time.Now().Add(timeout)
+	scrapeCallsMu.Lock()
+	if call, ok := scrapeCalls[key]; ok && time.Since(call.started) < scrapeCoalesce {
+		scrapeCallsMu.Unlock()
+		if scrapeJoined != nil {
+			scrapeJoined()
+		}
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		select {
+		case <-call.done:
+		case <-timer.C:
+			return nil, true, nats.ErrTimeout
+		case <-ctx.Done():
+			return nil, true, ctx.Err()
+		}
+		if left := time.Until(deadline); errors.Is(call.err, nats.ErrTimeout) && left > 0 {
+			msg, err := fetch(left)
+			return msg, false, err
+		}
+		return call.msg, true, call.err
+	}
+	call := &scrapeCall{done: make(chan struct{}), started: time.Now()}
+	scrapeCalls[key] = call
+	scrapeCallsMu.Unlock()
+
+	call.msg, call.err = fetch(timeout)
+
+	scrapeCallsMu.Lock()
+	// A newer call may have taken the key once the window passed
+	if scrapeCalls[key] == call {
+		delete(scrapeCalls, key)
+	}
+	scrapeCallsMu.Unlock()
+	close(call.done)
+
+	return call.msg, false, call.err
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+// Let a test know when a scrape joins a call in flight
+func watchJoins(t *testing.T) <-chan struct{} {
+	joined := make(chan struct{}, 10)
+	scrapeJoined = func() { joined <- struct{}{} }
+	t.Cleanup(func() { scrapeJoined = nil })
+	return joined
+}
+
+// Start a call on `key` that blocks until `release` is closed
+func leaderCall(key string, release <-chan struct{}, msg *nats.Msg, err error) <-chan struct{} {
+	started := make(chan struct{})
+	go coalescedRequest(context.Background(), key, time.Minute, func(time.Duration) (*nats.Msg, error) {
+		close(started)
+		<-release
+		return msg, err
+	})
+	return started
+}
+
+// Test identical scrapes in the window share one fetch and a later one fetches
+// again
+func TestCoalescedRequest(t *testing.T) {
+	defer func(d time.Duration) { scrapeCoalesce = d }(scrapeCoalesce)
+	scrapeCoalesce = time.Minute
+	joined := watchJoins(t)
+
+	release := make(chan struct{})
+	<-leaderCall("coalesce", release, &nats.Msg{Data: []byte("up 1\n")}, nil)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		msg, coalesced, err := coalescedRequest(context.Background(), "coalesce", time.Minute, nil)
+		if !coalesced || err != nil || string(msg.Data) != "up 1\n" {
+			t.Errorf("got %v, %v, %v", msg, coalesced, err)
+		}
+	}()
+	<-joined
+	close(release)
+	<-done
+
+	// Done calls are not reused
+	var fetches atomic.Int32
+	msg, coalesced, err := coalescedRequest(context.Background(), "coalesce", time.Minute, func(time.Duration) (*nats.Msg, error) {
+		fetches.Add(1)
+		return &nats.Msg{Data: []byte("up 2\n")}, nil
+	})
+	if coalesced || err != nil || string(msg.Data) != "up 2\n" || fetches.Load() != 1 {
+		t.Errorf("expected a new fetch, got %v, %v, %v", msg, coalesced, err)
+	}
+}
+
+// Test a call in flight past the window is not joined
+func TestCoalescedRequestWindow(t *testing.T) {
+	defer func(d time.Duration) { scrapeCoalesce = d }(scrapeCoalesce)
+	scrapeCoalesce = 10 * time.Millisecond
+
+	release := make(chan struct{})
+	defer close(release)
+	<-leaderCall("window", release, nil, errors.New("slow"))
+	time.Sleep(2 * scrapeCoalesce)
+
+	msg, coalesced, err := coalescedRequest(context.Background(), "window", time.Minute, func(time.Duration) (*nats.Msg, error) {
+		return &nats.Msg{Data: []byte("fresh")}, nil
+	})
+	if coalesced || err != nil || string(msg.Data) != "fresh" {
+		t.Errorf("got %v, %v, %v", msg, coalesced, err)
+	}
+}
+
+// Test a waiter gives up on its own context or timeout without cancelling the
+// fetch
+func TestCoalescedRequestCancel(t *testing.T) {
+	defer func(d time.Duration) { scrapeCoalesce = d }(scrapeCoalesce)
+	scrapeCoalesce = time.Minute
+
+	release := make(chan struct{})
+	defer close(release)
+	<-leaderCall("cancel", release, &nats.Msg{}, nil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, coalesced, err := coalescedRequest(ctx, "cancel", time.Minute, nil); !coalesced || !errors.Is(err, context.Canceled) {
+		t.Errorf("got %v, %v", coalesced, err)
+	}
+
+	start := time.Now()
+	if _, coalesced, err := coalescedRequest(context.Background(), "cancel", 20*time.Millisecond, nil); !coalesced || !errors.Is(err, nats.ErrTimeout) {
+		t.Errorf("got %v, %v", coalesced, err)
+	}
+	if waited := time.Since(start); waited > 10*time.Second {
+		t.Errorf("waited %v for the leader", waited)
+	}
+}
+
+// Test a waiter with time left sends its own request when the call it joined
+// timed out
+func TestCoalescedRequestLeaderTimeout(t *testing.T) {
+	defer func(d time.Duration) { scrapeCoalesce = d }(scrapeCoalesce)
+	scrapeCoalesce = time.Minute
+	joined := watchJoins(t)
+
+	release := make(chan struct{})
+	<-leaderCall("leader timeout", release, nil, nats.ErrTimeout)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		msg, coalesced, err := coalescedRequest(context.Background(), "leader timeout", time.Minute,
+			func(left time.Duration) (*nats.Msg, error) {
+				if left <= 0 || left > time.Minute {
+					t.Errorf("got %v left", left)
+				}
+				return &nats.Msg{Data: []byte("own")}, nil
+			})
+		if coalesced || err != nil || string(msg.Data) != "own" {
+			t.Errorf("got %v, %v, %v", msg, coalesced, err)
+		}
+	}()
+	<-joined
+	close(release)
+	<-done
+}
+
+// Test the key follows what changes the reply, not the rest of the headers
+func TestCoalesceKey(t *testing.T) {
+	base := coalesceKey("subj", "/metrics", "a=1", "text/plain", "gzip")
+	for name, other := range map[string]string{
+		"subject":         coalesceKey("other", "/metrics", "a=1", "text/plain", "gzip"),
+		"path":            coalesceKey("subj", "/probe", "a=1", "text/plain", "gzip"),
+		"params":          coalesceKey("subj", "/metrics", "a=2", "text/plain", "gzip"),
+		"accept":          coalesceKey("subj", "/metrics", "a=1", "application/openmetrics-text", "gzip"),
+		"accept encoding": coalesceKey("subj", "/metrics", "a=1", "text/plain", ""),
+	} {
+		if other == base {
+			t.Errorf("%s should change the key", name)
+		}
+	}
+}
@@ -0,0 +1,168 @@
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Exposition text compresses very well, replies are compressed for the NATS
+// hop with an encoding the scraper side says it can handle.
+const (
+	// Encodings the scraper side can decode, in order of preference
+	hdrAcceptEncoding = "X-Ambassador-Accept-Encoding"
+
+	// Do not bother compressing anything smaller
+	compressMinSize = 1024
+)
+
+// Largest body we decompress, guards against compression bombs
+var decodeMaxSize = 1 << 30
+
+// Encodings supported for the NATS hop, in order of preference
+var supportedEncodings = []string{"zstd", "gzip"}
+
+// Shared zstd encoder/decoder, `EncodeAll`/`DecodeAll` are safe to use
+// concurrently.
+var (
+	zstdEncoder, _ = zstd.NewWriter(nil, zstd.WithEncoderConcurrency(1))
+	zstdDecoder, _ = zstd.NewReader(nil,
+		zstd.WithDecoderConcurrency(0),
+		zstd.WithDecoderMaxMemory(uint64(decodeMaxSize)),
+	)
+)
+
+// Parse an `Accept-Encoding` style list in to the encodings allowed, anything
+// with `q=0` is left out.
+// https://www.rfc-editor.org/rfc/rfc9110#field.accept-encoding
+func parseEncodings(accept string) []string {
+	var encs []string
+	for _, part := range strings.Split(accept, ",") {
+		name, params, _ := strings.Cut(part, ";")
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+		if q, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			if v, err := strconv.ParseFloat(q, 64); err == nil && v == 0 {
+				continue
+			}
+		}
+		encs = append(encs, name)
+	}
+	return encs
+}
+
+// Check if `enc` is allowed by an `Accept-Encoding` style list
+func acceptsEncoding(accept, enc string) bool {
+	for _, e := range parseEncodings(accept) {
+		if e == enc || e == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+// First encoding from the accept list that we know how to produce
+func pickEncoding(accept string) string {
+	for _, e := range parseEncodings(accept) {
+		for _, s := range supportedEncodings {
+			if e == s {
+				return e
+			}
+		}
+	}
+	return ""
+}
+
+// Compress `body` with the given content encoding
+func encodeBody(enc string, body []byte) ([]byte, error) {
+	switch enc {
+	case "zstd":
+		return zstdEncoder.EncodeAll(body, make([]byte, 0, len(body)/4)), nil
+	case "gzip":
+		var buf bytes.Buffer
+		gz := gzip.NewWriter(&buf)
+		if _, err := gz.Write(body); err != nil {
+			return nil, err
+		}
+		if err := gz.Close(); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	}
+	return nil, fmt.Errorf("unsupported content encoding %q", enc)
+}
+
+// Decompress `body` with the given content encoding
+func decodeBody(enc string, body []byte) ([]byte, error) {
+	switch enc {
+	case "", "identity":
+		return body, nil
+	case "zstd":
+		return zstdDecoder.DecodeAll(body, nil)
+	case "gzip":
+		gz, err := gzip.NewReader(bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		defer gz.Close()
+		b, err := io.ReadAll(io.LimitReader(gz, int64(decodeMaxSize)+1))
+		if err == nil && len(b) > decodeMaxSize {
+			return nil, fmt.Errorf("decoded body exceeds %d bytes", decodeMaxSize)
+		}
+		return b, err
+	}
+	return nil, fmt.Errorf("unsupported content encoding %q", enc)
+}
+
+// Compress a reply for the NATS hop. Replies the exporter already compressed
+// with something the scraper side accepts go through untouched, anything else
+// gets decompressed so the scraper side can always read it.
+func compressReply(reply *exporterReply, accept string) error {
+	if reply.Header == nil {
+		reply.Header = http.Header{}
+	}
+	enc := strings.ToLower(reply.Header.Get("Content-Encoding"))
+
+	if enc != "" && enc != "identity" {
+		if acceptsEncoding(accept, enc) {
+			return nil
+		}
+		body, err := decodeBody(enc, reply.Body)
+		if err != nil {
+			return fmt.Errorf("failed to decode %v reply: %w", enc, err)
+		}
+		reply.Body = body
+		reply.Header.Del("Content-Encoding")
+	}
+
+	enc = pickEncoding(accept)
+	if enc == "" || len(reply.Body) < compressMinSize {
+		return nil
+	}
+	body, err := encodeBody(enc, reply.Body)
+	if err != nil {
+		return err
+	}
+	reply.Body = body
+	reply.Header.Set("Content-Encoding", enc)
+	return nil
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+// Test accept lists, `q=0` turns an encoding off
+func TestParseEncodings(t *testing.T) {
+	tests := []struct {
+		accept string
+		want   []string
+	}{
+		{"", nil},
+		{"zstd,gzip", []string{"zstd", "gzip"}},
+		{" GZIP ; q=0.5 , zstd", []string{"gzip", "zstd"}},
+		{"gzip;q=0, zstd;q=1", []string{"zstd"}},
+		{"gzip;q=0.0,identity", []string{"identity"}},
+		{",,br", []string{"br"}},
+	}
+	for _, tt := range tests {
+		if got := parseEncodings(tt.accept); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseEncodings(%q) = %q, want %q", tt.accept, got, tt.want)
+		}
+	}
+
+	for _, tt := range []struct {
+		accept, enc string
+		want        bool
+	}{
+		{"gzip", "gzip", true},
+		{"gzip;q=0", "gzip", false},
+		{"*", "zstd", true},
+		{"*;q=0", "zstd", false},
+		{"zstd", "gzip", false},
+	} {
+		if got := acceptsEncoding(tt.accept, tt.enc); got != tt.want {
+			t.Errorf("acceptsEncoding(%q, %q) = %v", tt.accept, tt.enc, got)
+		}
+	}
+
+	if got := pickEncoding("br, gzip;q=0, zstd"); got != "zstd" {
+		t.Errorf("pickEncoding = %q, want zstd", got)
+	}
+}
+
+// Test replies are compressed with an accepted encoding, passed through when
+// already in one and decoded otherwise
+func TestCompressReply(t *testing.T) {
+	body := bytes.Repeat([]byte("node_cpu_seconds_total{cpu=\"0\"} 1\n"), 100)
+
+	for _, enc := range supportedEncodings {
+		reply := &exporterReply{Body: body}
+		if err := compressReply(reply, enc); err != nil {
+			t.Fatal(err)
+		}
+		if got := reply.Header.Get("Content-Encoding"); got != enc {
+			t.Fatalf("got encoding %q, want %q", got, enc)
+		}
+		if len(reply.Body) >= len(body) {
+			t.Errorf("%v: body not compressed", enc)
+		}
+		if decoded, err := decodeBody(enc, reply.Body); err != nil || !bytes.Equal(decoded, body) {
+			t.Errorf("%v: round trip failed: %v", enc, err)
+		}
+	}
+
+	// Small and unaccepted replies are left alone
+	small := &exporterReply{Body: []byte("up 1\n")}
+	if err := compressReply(small, "zstd"); err != nil || small.Header.Get("Content-Encoding") != "" {
+		t.Errorf("small reply compressed: %v", err)
+	}
+	plain := &exporterReply{Body: body}
+	if err := compressReply(plain, "br"); err != nil || !bytes.Equal(plain.Body, body) {
+		t.Errorf("reply changed without an accepted encoding: %v", err)
+	}
+
+	gz, err := encodeBody("gzip", body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Already gzip and the scraper side takes gzip
+	pass := &exporterReply{Header: http.Header{"Content-Encoding": {"gzip"}}, Body: gz}
+	if err := compressReply(pass, "zstd, gzip"); err != nil || !bytes.Equal(pass.Body, gz) {
+		t.Errorf("expected gzip passthrough: %v", err)
+	}
+
+	// Gzip is turned off, decoded then compressed again
+	recoded := &exporterReply{Header: http.Header{"Content-Encoding": {"gzip"}}, Body: gz}
+	if err := compressReply(recoded, "gzip;q=0, zstd"); err != nil {
+		t.Fatal(err)
+	}
+	if recoded.Header.Get("Content-Encoding") != "zstd" {
+		t.Errorf("got encoding %q, want zstd", recoded.Header.Get("Content-Encoding"))
+	}
+	if decoded, _ := decodeBody("zstd", recoded.Body); !bytes.Equal(decoded, body) {
+		t.Errorf("recoded body does not match")
+	}
+
+	// Nothing accepted, sent plain
+	decoded := &exporterReply{Header: http.Header{"Content-Encoding": {"gzip"}}, Body: gz}
+	if err := compressReply(decoded, ""); err != nil || !bytes.Equal(decoded.Body, body) {
+		t.Errorf("expected plain body: %v", err)
+	}
+	if decoded.Header.Get("Content-Encoding") != "" {
+		t.Errorf("encoding header left on plain body")
+	}
+
+	broken := &exporterReply{Header: http.Header{"Content-Encoding": {"gzip"}}, Body: []byte("nope")}
+	if err := compressReply(broken, "zstd"); err == nil {
+		t.Errorf("expected error for a broken gzip body")
+	}
+}
+
+// Test decompressed size is capped
+func TestDecodeBodyLimit(t *testing.T) {
+	defer func(n int) { decodeMaxSize = n }(decodeMaxSize)
+	decodeMaxSize = 1024
+
+	gz, err := encodeBody("gzip", make([]byte, 2048))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := decodeBody("gzip", gz); err == nil {
+		t.Errorf("expected error over the limit")
+	}
+
+	gz, _ = encodeBody("gzip", make([]byte, 1024))
+	if b, err := decodeBody("gzip", gz); err != nil || len(b) != 1024 {
+		t.Errorf("got %d bytes, %v", len(b), err)
+	}
+}
@@ -0,0 +1,242 @@
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/nats-io/nats.go"
+
+	"github.com/insikl/prometheus-nats-ambassador/internal/logger"
+	"github.com/insikl/prometheus-nats-ambassador/internal/models"
+)
+
+// Service discovery over NATS. Every exporter side ambassador answers requests
+// on the discovery subject with the topics it serves, the scraper side gathers
+// the replies and serves them as Prometheus HTTP service discovery.
+// https://prometheus.io/docs/prometheus/latest/http_sd/
+var (
+	// Kept outside of `topicBase` so it can never collide with a target
+	discoverySubject = "io.prometheus.ambassador.discovery"
+	// How long to wait for exporter side ambassadors to reply
+	discoveryWait = 2 * time.Second
+
+	// Hostname of this ambassador shared in discovery replies
+	ambassadorHostname, _ = os.Hostname()
+)
+
+// Label prefix for target labels, same convention as Prometheus `__meta_*`
+const discoveryLabelPrefix = "__meta_natsambassador_"
+
+// Subscription metadata key to set the target address explicitly, needed when
+// the subject cannot be mapped back to `host:port`.
+const metadataTarget = "target"
+
+// Metadata keys with this prefix are announced and become target labels, the
+// rest of the metadata configures the route (credentials, files, commands) and
+// never leaves the ambassador.
+const metadataLabelPrefix = "label_"
+
+// Metadata safe to announce over NATS, the target and `label_*` keys
+func announcedMetadata(md map[string]string) map[string]string {
+	var out map[string]string
+	for k, v := range md {
+		if k != metadataTarget && !strings.HasPrefix(k, metadataLabelPrefix) {
+			continue
+		}
+		if out == nil {
+			out = make(map[string]string)
+		}
+		out[k] = v
+	}
+	return out
+}
+
+// What this ambassador serves, used for discovery replies
+func newAnnouncement() models.Announcement {
+	announce := models.Announcement{
+		Hostname:  ambassadorHostname,
+		Instance:  instanceName,
+		Version:   BuildVersion,
+		Timestamp: time.Now(),
+	}
+	for _, route := range topicMap {
+		announce.Subscriptions = append(announce.Subscriptions, models.AnnouncedTopic{
+			PubSubName: route.sub.PubSubName,
+			Topic:      route.sub.Topic,
+			Metadata:   announcedMetadata(route.sub.Metadata),
+		})
+	}
+	sort.Slice(announce.Subscriptions, func(i, j int) bool {
+		return announce.Subscriptions[i].Topic < announce.Subscriptions[j].Topic
+	})
+	return announce
+}
+
+// NATS handler for discovery requests on the exporter side
+func (pubsub *ProxyConn) DiscoveryRequestHandler(msg *nats.Msg) {
+	payload, err := json.Marshal(newAnnouncement())
+	if err != nil {
+		logger.Error("Error encoding discovery reply: %v", err)
+		return
+	}
+	if err := msg.Respond(payload); err != nil {
+		logger.Error("Error sending discovery reply: %v", err)
+	}
+}
+
+// Ask every exporter side ambassador what it serves, waits the full discovery
+// window as there is no way to know how many will reply.
+func (pubsub *ProxyConn) discover(wait time.Duration) ([]models.Announcement, error) {
+	inbox := nats.NewInbox()
+	sub, err := pubsub.nc.SubscribeSync(inbox)
+	if err != nil {
+		return nil, err
+	}
+	defer sub.Unsubscribe()
+
+	if err := pubsub.nc.PublishRequest(discoverySubject, inbox, nil); err != nil {
+		return nil, err
+	}
+
+	var announcements []models.Announcement
+	deadline := time.Now().Add(wait)
+	for {
+		msg, err := sub.NextMsg(time.Until(deadline))
+		if err != nil {
+			// Timeout is the normal end of the discovery window
+			break
+		}
+		var announce models.Announcement
+		if err := json.Unmarshal(msg.Data, &announce); err != nil {
+			logger.Warn("Invalid discovery reply: %v", err)
+			continue
+		}
+		announcements = append(announcements, announce)
+	}
+	return announcements, nil
+}
+
+// Turn a metadata key in to a valid label name
+var invalidLabelChars = regexp.MustCompile(`[^a-zA-Z0-9_]`)
+
+// Build HTTP service discovery target groups from discovery replies
+func targetGroups(announcements []models.Announcement, pubsubName string) []models.TargetGroup {
+	groups := []models.TargetGroup{}
+	for _, announce := range announcements {
+		for _, topic := range announce.Subscriptions {
+			if pubsubName != "" && topic.PubSubName != pubsubName {
+				continue
+			}
+			// Wildcard topics can not be listed as targets
+			if isWildcardSubject(topic.Topic) {
+				continue
+			}
+
+			target := topic.Metadata[metadataTarget]
+			if target == "" {
+				var ok bool
+				if target, ok = subjectTarget(topic.Topic); !ok {
+					if showDebug {
+						logger.Debug("Skipping discovery of [%v], no target address", topic.Topic)
+					}
+					continue
+				}
+			}
+
+			labels := map[string]string{
+				"__metrics_path__":                  "/proxy",
+				discoveryLabelPrefix + "subject":    topic.Topic,
+				discoveryLabelPrefix + "pubsubname": topic.PubSubName,
+				discoveryLabelPrefix + "hostname":   announce.Hostname,
+				discoveryLabelPrefix + "version":    announce.Version,
+			}
+			// Older ambassadors announce all of their metadata, only take labels
+			for k, v := range topic.Metadata {
+				name, ok := strings.CutPrefix(k, metadataLabelPrefix)
+				if !ok || name == "" {
+					continue
+				}
+				labels[discoveryLabelPrefix+"label_"+invalidLabelChars.ReplaceAllString(name, "_")] = v
+			}
+
+			groups = append(groups, models.TargetGroup{
+				Targets: []string{target},
+				Labels:  labels,
+			})
+		}
+	}
+	// Same target can be served by several ambassadors or subjects, order on
+	// the labels too so the output does not change between polls
+	sort.SliceStable(groups, func(i, j int) bool {
+		if groups[i].Targets[0] != groups[j].Targets[0] {
+			return groups[i].Targets[0] < groups[j].Targets[0]
+		}
+		return labelsKey(groups[i].Labels) < labelsKey(groups[j].Labels)
+	})
+	return groups
+}
+
+// Labels as one string sorted by name, for ordering target groups
+func labelsKey(labels map[string]string) string {
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var b strings.Builder
+	for _, name := range names {
+		b.WriteString(name)
+		b.WriteByte('=')
+		b.WriteString(labels[name])
+		b.WriteByte(0)
+	}
+	return b.String()
+}
+
+// HTTP handler function for `/sd` endpoint, Prometheus `http_sd_configs`
+// compatible list of every target currently reachable over NATS. Optional
+// `?pubsubname=` filters to one kind of exporter.
+func (pubsub *ProxyConn) ServiceDiscoveryHandler(w http.ResponseWriter, r *http.Request) {
+	announcements, err := pubsub.discover(discoveryWait)
+	if err != nil {
+		logger.Error("Error on discovery request: %v", err)
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+
+	// Fill in ambassadors that did not reply in time but are still sending
+	// heartbeats
+	replied := make(map[string]bool)
+	for _, announce := range announcements {
+		replied[announceKey(announce)] = true
+	}
+	for _, announce := range liveHeartbeats() {
+		if !replied[announceKey(announce)] {
+			announcements = append(announcements, announce)
+		}
+	}
+
+	payload, err := json.Marshal(targetGroups(announcements, r.URL.Query().Get("pubsubname")))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(payload)
+}
@@ -0,0 +1,108 @@
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	"google.golang.org/protobuf/proto"
+)
+
+// Parsing and encoding of exporter replies for relabeling and aggregation.
+// https://prometheus.io/docs/instrumenting/exposition_formats/
+
+// `Accept` header to send an exporter when the reply has to be parsed. Only
+// formats expfmt can decode are asked for, protobuf if the scraper wants it so
+// native histograms survive and the text format otherwise.
+func parseableAccept(accept string) string {
+	format := expfmt.NegotiateIncludingOpenMetrics(http.Header{"Accept": {accept}})
+	if format.FormatType() == expfmt.TypeProtoDelim {
+		return string(expfmt.NewFormat(expfmt.TypeProtoDelim))
+	}
+	return "text/plain;version=0.0.4"
+}
+
+// Parse the metric families of an exporter reply
+func decodeFamilies(reply *exporterReply) ([]*dto.MetricFamily, error) {
+	body := reply.Body
+	if enc := reply.Header.Get("Content-Encoding"); enc != "" {
+		b, err := decodeBody(strings.ToLower(enc), body)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode %v reply: %w", enc, err)
+		}
+		body = b
+	}
+
+	format := expfmt.ResponseFormat(reply.Header)
+	if format.FormatType() == expfmt.TypeUnknown {
+		return nil, fmt.Errorf("cannot parse content type %q", reply.Header.Get("Content-Type"))
+	}
+
+	var families []*dto.MetricFamily
+	dec := expfmt.NewDecoder(bytes.NewReader(body), format)
+	for {
+		mf := &dto.MetricFamily{}
+		if err := dec.Decode(mf); err != nil {
+			if errors.Is(err, io.EOF) {
+				return families, nil
+			}
+			return nil, fmt.Errorf("failed to parse exporter reply: %w", err)
+		}
+		families = append(families, mf)
+	}
+}
+
+// Encode metric families sorted by name in the format negotiated from the
+// scraper `Accept` header
+func encodeFamilies(families map[string]*dto.MetricFamily, accept string) ([]byte, expfmt.Format, error) {
+	names := make([]string, 0, len(families))
+	for name, mf := range families {
+		if len(mf.GetMetric()) > 0 {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	format := expfmt.NegotiateIncludingOpenMetrics(http.Header{"Accept": {accept}})
+	var buf bytes.Buffer
+	enc := expfmt.NewEncoder(&buf, format)
+	for _, name := range names {
+		if err := enc.Encode(families[name]); err != nil {
+			return nil, format, fmt.Errorf("failed to encode %v: %w", name, err)
+		}
+	}
+	if closer, ok := enc.(expfmt.Closer); ok {
+		if err := closer.Close(); err != nil {
+			return nil, format, err
+		}
+	}
+	return buf.Bytes(), format, nil
+}
+
+// Replace the labels of a metric, sorted by name
+func setLabels(m *dto.Metric, labels map[string]string) {
+	m.Label = m.Label[:0]
+	for k, v := range labels {
+		m.Label = append(m.Label, &dto.LabelPair{Name: proto.String(k), Value: proto.String(v)})
+	}
+	sort.Slice(m.Label, func(i, j int) bool {
+		return m.Label[i].GetName() < m.Label[j].GetName()
+	})
+}
@@ -0,0 +1,148 @@
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"encoding/json"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go"
+
+	"github.com/insikl/prometheus-nats-ambassador/internal/logger"
+	"github.com/insikl/prometheus-nats-ambassador/internal/models"
+)
+
+// Exporter side ambassadors publish what they serve on the heartbeat subject
+// at startup and on an interval, so central tooling can tell which ones exist
+// without asking. Each heartbeat expires after a few missed intervals.
+var (
+	heartbeatInterval = 30 * time.Second
+)
+
+// Heartbeats missed before an ambassador is considered gone
+const heartbeatMissed = 3
+
+// Subject heartbeats are published on, under the discovery subject
+func heartbeatSubject() string {
+	return discoverySubject + ".heartbeat"
+}
+
+// Publish heartbeats until the connection is closed
+func (pubsub *ProxyConn) runHeartbeat(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		announce := newAnnouncement()
+		announce.Interval = interval.Seconds()
+		announce.Expires = announce.Timestamp.Add(heartbeatMissed * interval)
+
+		payload, err := json.Marshal(announce)
+		if err != nil {
+			logger.Error("Error encoding heartbeat: %v", err)
+		} else if err := pubsub.nc.Publish(heartbeatSubject(), payload); err != nil {
+			logger.Error("Error publishing heartbeat: %v", err)
+		}
+
+		<-ticker.C
+		if pubsub.nc.IsClosed() {
+			return
+		}
+	}
+}
+
+// Last heartbeat seen from an exporter side ambassador, expiry is worked out
+// from when it was received so clock skew between hosts does not matter.
+type heartbeat struct {
+	announce models.Announcement
+	expires  time.Time
+}
+
+// Last heartbeat seen from each exporter side ambassador, keyed by instance
+// name as several can run on one host
+var (
+	heartbeatMu sync.Mutex
+	heartbeats  = make(map[string]heartbeat)
+)
+
+// NATS handler for heartbeats on the scraper side
+func (pubsub *ProxyConn) HeartbeatHandler(msg *nats.Msg) {
+	var announce models.Announcement
+	if err := json.Unmarshal(msg.Data, &announce); err != nil {
+		logger.Warn("Invalid heartbeat on [%v]: %v", msg.Subject, err)
+		return
+	}
+	if announce.Hostname == "" {
+		logger.Warn("Heartbeat on [%v] missing hostname", msg.Subject)
+		return
+	}
+	if showDebug {
+		logger.Debug("heartbeat from [%v] version %v with %d topics",
+			announceKey(announce),
+			announce.Version,
+			len(announce.Subscriptions),
+		)
+	}
+
+	interval := time.Duration(announce.Interval * float64(time.Second))
+	if interval <= 0 {
+		interval = heartbeatInterval
+	}
+
+	key := announceKey(announce)
+	heartbeatMu.Lock()
+	if prev, ok := heartbeats[key]; ok &&
+		(prev.announce.Hostname != announce.Hostname || prev.announce.Version != announce.Version) {
+		heartbeatTimestamp.DeleteLabelValues(key, prev.announce.Hostname, prev.announce.Version)
+	}
+	heartbeats[key] = heartbeat{
+		announce: announce,
+		expires:  time.Now().Add(heartbeatMissed * interval),
+	}
+	heartbeatMu.Unlock()
+
+	heartbeatTimestamp.WithLabelValues(key, announce.Hostname, announce.Version).
+		Set(float64(announce.Timestamp.Unix()))
+}
+
+// Instance name of an announcement, older ambassadors only send the hostname
+func announceKey(announce models.Announcement) string {
+	if announce.Instance != "" {
+		return announce.Instance
+	}
+	return announce.Hostname
+}
+
+// Heartbeats that have not expired yet, expired ones are dropped along with
+// their metrics.
+func liveHeartbeats() []models.Announcement {
+	heartbeatMu.Lock()
+	defer heartbeatMu.Unlock()
+
+	now := time.Now()
+	var live []models.Announcement
+	for key, hb := range heartbeats {
+		if now.After(hb.expires) {
+			logger.Warn("Heartbeat from [%v] expired at %v", key, hb.expires)
+			heartbeatTimestamp.DeleteLabelValues(key, hb.announce.Hostname, hb.announce.Version)
+			delete(heartbeats, key)
+			continue
+		}
+		live = append(live, hb.announce)
+	}
+	sort.Slice(live, func(i, j int) bool {
+		return announceKey(live[i]) < announceKey(live[j])
+	})
+	return live
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"github.com/insikl/prometheus-nats-ambassador/internal/models"
+)
+
+func publishHeartbeat(t *testing.T, announce models.Announcement) {
+	t.Helper()
+	payload, err := json.Marshal(announce)
+	if err != nil {
+		t.Fatal(err)
+	}
+	(&ProxyConn{}).HeartbeatHandler(&nats.Msg{Subject: heartbeatSubject(), Data: payload})
+}
+
+// Test ambassadors on one host are tracked apart and expire on their own
+func TestHeartbeats(t *testing.T) {
+	defer func() {
+		heartbeats = make(map[string]heartbeat)
+		heartbeatTimestamp.Reset()
+	}()
+	heartbeats = make(map[string]heartbeat)
+	heartbeatTimestamp.Reset()
+
+	now := time.Now()
+	publishHeartbeat(t, models.Announcement{Hostname: "host1", Instance: "b", Version: "1", Timestamp: now, Interval: 60})
+	publishHeartbeat(t, models.Announcement{Hostname: "host1", Instance: "a", Version: "1", Timestamp: now, Interval: 60})
+	// Older ambassadors without an instance name
+	publishHeartbeat(t, models.Announcement{Hostname: "host2", Version: "1", Timestamp: now, Interval: 60})
+	// Not an ambassador
+	publishHeartbeat(t, models.Announcement{Version: "1"})
+	(&ProxyConn{}).HeartbeatHandler(&nats.Msg{Data: []byte("{")})
+
+	live := liveHeartbeats()
+	var keys []string
+	for _, a := range live {
+		keys = append(keys, announceKey(a))
+	}
+	if len(keys) != 3 || keys[0] != "a" || keys[1] != "b" || keys[2] != "host2" {
+		t.Fatalf("got live heartbeats %q", keys)
+	}
+	if n := testutil.CollectAndCount(heartbeatTimestamp); n != 3 {
+		t.Errorf("got %d heartbeat series, want 3", n)
+	}
+
+	// New version replaces the old series
+	publishHeartbeat(t, models.Announcement{Hostname: "host1", Instance: "a", Version: "2", Timestamp: now, Interval: 60})
+	if n := testutil.CollectAndCount(heartbeatTimestamp); n != 3 {
+		t.Errorf("got %d heartbeat series after upgrade, want 3", n)
+	}
+	if v := testutil.ToFloat64(heartbeatTimestamp.WithLabelValues("a", "host1", "2")); v != float64(now.Unix()) {
+		t.Errorf("got timestamp %v", v)
+	}
+
+	// Expired heartbeats drop off with their metrics
+	heartbeatMu.Lock()
+	hb := heartbeats["b"]
+	hb.expires = time.Now().Add(-time.Second)
+	heartbeats["b"] = hb
+	heartbeatMu.Unlock()
+
+	if live := liveHeartbeats(); len(live) != 2 {
+		t.Errorf("got %d live heartbeats, want 2", len(live))
+	}
+	if n := testutil.CollectAndCount(heartbeatTimestamp); n != 2 {
+		t.Errorf("got %d heartbeat series after expiry, want 2", n)
+	}
+
+	// Expiry follows the announced interval
+	heartbeatMu.Lock()
+	left := time.Until(heartbeats["host2"].expires)
+	heartbeatMu.Unlock()
+	if left < 2*time.Minute || left > heartbeatMissed*time.Minute {
+		t.Errorf("got expiry in %v, want about %v", left, heartbeatMissed*time.Minute)
+	}
+}
@@ -19,6 +19,7 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"strings"
 	"time"
 
 	"github.com/nats-io/nats.go"
@@ -48,10 +49,10 @@ var (
 )
 
 // Follows the same structure if pulled from dapr, get a list of topic/subject
-// and the routes they need to call back to. Does not implement the `rules` yet
+// and the routes they need to call back to, including any route `rules`.
 // https://docs.dapr.io/developing-applications/building-blocks/pubsub/subscription-methods/#programmatic-subscriptions
 var (
-	topicMap = make(map[string]string)
+	topicMap = make(map[string]*exporterRoute)
 	// Topic base to publish requests to in the format of
 	//  topicBase + host + port
 	topicBase = "io.prometheus.exporter."
@@ -67,6 +68,14 @@ var (
 	)
 	topicRemoteWrite = ""
 	showDebug        = false
+
+	// Default queue group for exporter subscriptions and the name this
+	// ambassador reports as having served a request
+	queueGroup   = ""
+	instanceName = ambassadorHostname
+
+	// Encodings the scraper side asks for on replies over NATS
+	scrapeEncodings = strings.Join(supportedEncodings, ",")
 )
 
 func usage() {
@@ -85,13 +94,15 @@ func showUsageAndExit(exitcode int) {
 // Handler/Context for NATS connection sharing to functions
 type ProxyConn struct {
 	nc *nats.Conn
+	// Set when remote write goes through JetStream, see `-jsstream`
+	js nats.JetStreamContext
 }
 
 func ProxyContext(nc *nats.Conn) *ProxyConn {
 	if nc == nil {
 		panic("nil NATS session!")
 	}
-	return &ProxyConn{nc}
+	return &ProxyConn{nc: nc}
 }
 
 // Internal metrics
@@ -119,12 +130,233 @@ var (
 			"code",
 		},
 	)
+
+	proxyServedBy = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "natsambassador",
+			Name:      "requests_served_total",
+			Help:      "No of requests by the exporter side ambassador instance that served them",
+		},
+		[]string{
+			"subject",
+			"instance",
+		},
+	)
+
+	proxyCoalesced = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "natsambassador",
+			Name:      "requests_coalesced_total",
+			Help:      "No of requests answered by joining an identical NATS request in flight",
+		},
+		[]string{
+			"subject",
+		},
+	)
+
+	subscriptionQueueDepth = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "natsambassador",
+			Name:      "subscription_queue_depth",
+			Help:      "No of requests waiting for a worker per subscription",
+		},
+		[]string{
+			"subject",
+		},
+	)
+
+	subscriptionDropped = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "natsambassador",
+			Name:      "subscription_dropped_total",
+			Help:      "No of requests dropped over the in-flight limit per subscription",
+		},
+		[]string{
+			"subject",
+		},
+	)
+
+	natsSlowConsumer = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "natsambassador",
+			Name:      "slow_consumer_total",
+			Help:      "No of NATS slow consumer events per subscription",
+		},
+		[]string{
+			"subject",
+		},
+	)
+
+	remoteWriteTranscodeBytes = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "natsambassador",
+			Name:      "remote_write_transcode_bytes_total",
+			Help:      "Bytes of remote write before and after transcoding between encodings",
+		},
+		[]string{
+			"from",
+			"to",
+			"stage",
+		},
+	)
+
+	remoteWriteAcks = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "natsambassador",
+			Name:      "remote_write_jetstream_acks_total",
+			Help:      "No of remote write messages acked, nak'ed or terminated by the JetStream relay",
+		},
+		[]string{
+			"result",
+		},
+	)
+
+	remoteWriteQueueDepth = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "natsambassador",
+			Name:      "remote_write_queue_depth",
+			Help:      "Remote write messages waiting in the relay queue of a downstream",
+		},
+		[]string{
+			"url",
+		},
+	)
+
+	remoteWriteQueueDropped = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "natsambassador",
+			Name:      "remote_write_queue_dropped_total",
+			Help:      "No of remote write messages dropped on a full relay queue",
+		},
+		[]string{
+			"url",
+		},
+	)
+
+	remoteWriteRetriesTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "natsambassador",
+			Name:      "remote_write_retries_total",
+			Help:      "No of remote write requests sent again after a retryable failure",
+		},
+		[]string{
+			"url",
+		},
+	)
+
+	remoteWriteGiveUps = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "natsambassador",
+			Name:      "remote_write_retry_giveups_total",
+			Help:      "No of remote write messages given up on after spending the retry budget",
+		},
+		[]string{
+			"url",
+		},
+	)
+
+	remoteWriteRetrySeconds = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "natsambassador",
+			Name:      "remote_write_retry_seconds_total",
+			Help:      "Time spent retrying remote write requests",
+		},
+		[]string{
+			"url",
+		},
+	)
+
+	routeUp = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "natsambassador",
+			Name:      "route_up",
+			Help:      "Result of the last exporter health check per subscription, 1 up and 0 down",
+		},
+		[]string{
+			"subject",
+		},
+	)
+
+	relabelDropped = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "natsambassador",
+			Name:      "relabel_series_dropped_total",
+			Help:      "No of series dropped by metric relabeling before replying over NATS",
+		},
+		[]string{
+			"subject",
+		},
+	)
+
+	cacheHits = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "natsambassador",
+			Name:      "cache_hits_total",
+			Help:      "No of requests answered from the exporter side reply cache",
+		},
+		[]string{
+			"subject",
+		},
+	)
+
+	cacheMisses = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "natsambassador",
+			Name:      "cache_misses_total",
+			Help:      "No of requests fetched from the exporter on routes with a reply cache",
+		},
+		[]string{
+			"subject",
+		},
+	)
+
+	heartbeatTimestamp = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "natsambassador",
+			Name:      "discovery_last_heartbeat_timestamp_seconds",
+			Help:      "Unix time of the last heartbeat from an exporter side ambassador",
+		},
+		[]string{
+			"instance",
+			"hostname",
+			"version",
+		},
+	)
+
+	// Evaluated on scrape so expired heartbeats drop off without waiting for
+	// a discovery request
+	heartbeatAmbassadors = prometheus.NewGaugeFunc(
+		prometheus.GaugeOpts{
+			Namespace: "natsambassador",
+			Name:      "discovery_ambassadors",
+			Help:      "No of exporter side ambassadors with a live heartbeat",
+		},
+		func() float64 { return float64(len(liveHeartbeats())) },
+	)
 )
 
 func main() {
 	// Register PromHTTP request/reply counters
 	prometheus.MustRegister(proxyRequest)
 	prometheus.MustRegister(proxyReply)
+	prometheus.MustRegister(proxyServedBy)
+	prometheus.MustRegister(proxyCoalesced)
+	prometheus.MustRegister(subscriptionQueueDepth)
+	prometheus.MustRegister(subscriptionDropped)
+	prometheus.MustRegister(natsSlowConsumer)
+	prometheus.MustRegister(remoteWriteTranscodeBytes)
+	prometheus.MustRegister(remoteWriteAcks)
+	prometheus.MustRegister(remoteWriteQueueDepth)
+	prometheus.MustRegister(remoteWriteQueueDropped)
+	prometheus.MustRegister(remoteWriteRetriesTotal)
+	prometheus.MustRegister(remoteWriteGiveUps)
+	prometheus.MustRegister(remoteWriteRetrySeconds)
+	prometheus.MustRegister(routeUp)
+	prometheus.MustRegister(relabelDropped)
+	prometheus.MustRegister(cacheHits)
+	prometheus.MustRegister(cacheMisses)
+	prometheus.MustRegister(heartbeatTimestamp)
+	prometheus.MustRegister(heartbeatAmbassadors)
 
 	// CLI options
 	var natsUrls = flag.String(
@@ -168,7 +400,87 @@ func main() {
 	var remoteWrite = flag.String(
 		"remotewrite",
 		topicRemoteWrite,
-		"Remote write endpoint, cannot be used with '-subs'",
+		"Remote write endpoints (separated by comma) as URL|encoding=snappy|zstd|passthrough|protocol=v1|passthrough, cannot be used with '-subs'",
+	)
+	var rwEncoding = flag.String(
+		"rwencoding",
+		remoteWriteEncoding,
+		"Transcode remote write to snappy or zstd before publishing, empty to keep",
+	)
+	var rwQueue = flag.Int(
+		"rwqueue",
+		remoteWriteQueueSize,
+		"Remote write messages queued per endpoint on the relay without JetStream",
+	)
+	var rwRetries = flag.Int(
+		"rwretries",
+		remoteWriteMaxRetries,
+		"Retries of a remote write request on 429, 5xx or connection errors, 0 to disable",
+	)
+	var rwRetryBudget = flag.Duration(
+		"rwretrybudget",
+		remoteWriteRetryBudget,
+		"Max time to spend on retries of one remote write request",
+	)
+	var rwMinBackoff = flag.Duration(
+		"rwminbackoff",
+		remoteWriteMinBackoff,
+		"Initial remote write retry backoff, doubled on each retry",
+	)
+	var rwMaxBackoff = flag.Duration(
+		"rwmaxbackoff",
+		remoteWriteMaxBackoff,
+		"Max remote write retry backoff",
+	)
+	var spoolDirectory = flag.String(
+		"spooldir",
+		spoolDir,
+		"Directory to spool remote write the relay could not deliver, empty to disable",
+	)
+	var spoolMax = flag.Int64(
+		"spoolmaxbytes",
+		spoolMaxBytes,
+		"Size cap of the remote write spool per endpoint, the oldest data is dropped over it",
+	)
+	var spoolSegment = flag.Int64(
+		"spoolsegmentbytes",
+		spoolSegmentBytes,
+		"Size of the remote write spool segment files",
+	)
+	var spoolRetry = flag.Duration(
+		"spoolretry",
+		spoolRetryInterval,
+		"Interval to retry replaying the remote write spool while the endpoint is down",
+	)
+	var jetStream = flag.String(
+		"jsstream",
+		jsStream,
+		"JetStream stream for durable remote write, empty for core NATS",
+	)
+	var jetStreamDurable = flag.String(
+		"jsdurable",
+		jsDurable,
+		"Durable consumer name of the remote write relay",
+	)
+	var jetStreamMaxDeliver = flag.Int(
+		"jsmaxdeliver",
+		jsMaxDeliver,
+		"Deliveries of a remote write message before giving up, 0 for no limit",
+	)
+	var jetStreamAckWait = flag.Duration(
+		"jsackwait",
+		jsAckWait,
+		"Time for the relay to ack a remote write message before it is redelivered",
+	)
+	var jetStreamBackoff = flag.String(
+		"jsbackoff",
+		"1s,5s,30s,1m,5m",
+		"Redelivery delays (separated by comma) after a failed relay, the last one repeats",
+	)
+	var probeMapFile = flag.String(
+		"probemap",
+		"",
+		"Mapping table file for '/probe' targets to ambassador",
 	)
 	var basePub = flag.String(
 		"subjbase",
@@ -178,7 +490,102 @@ func main() {
 	var baseFmt = flag.String(
 		"subjfmt",
 		topicFmt,
-		"Set subject/topic format fwd, rev, or mod",
+		"Set subject/topic format fwd, rev, mod or a Go template",
+	)
+	var portMapFile = flag.String(
+		"portmap",
+		"",
+		"JSON file of port to exporter name for subject templates",
+	)
+	var subjMapFile = flag.String(
+		"subjmap",
+		"",
+		"JSON file of host:port to exact subject overrides",
+	)
+	var acceptEncodings = flag.String(
+		"encodings",
+		scrapeEncodings,
+		"Encodings accepted for replies over NATS (zstd, gzip), empty to disable",
+	)
+	var discoverySubj = flag.String(
+		"discoverysubj",
+		discoverySubject,
+		"Subject for service discovery requests",
+	)
+	var discoveryTimeout = flag.Duration(
+		"discoverywait",
+		discoveryWait,
+		"How long to wait for discovery replies",
+	)
+	var heartbeatEvery = flag.Duration(
+		"heartbeat",
+		heartbeatInterval,
+		"Interval to publish heartbeats of served subscriptions, 0 to disable",
+	)
+	var targetOrderList = flag.String(
+		"targetorder",
+		strings.Join(targetOrder, ","),
+		"Order to resolve the scrape target from param, forwarded, xforwarded, uri, host",
+	)
+	var targetParamName = flag.String(
+		"targetparam",
+		targetParam,
+		"Query param to set the scrape target explicitly",
+	)
+	var queueName = flag.String(
+		"queue",
+		queueGroup,
+		"Queue group for subscriptions, metadata 'queue' overrides per subscription",
+	)
+	var coalesceWindow = flag.Duration(
+		"coalesce",
+		scrapeCoalesce,
+		"Window to join identical scrapes in flight to one NATS request, 0 to disable",
+	)
+	var concurrency = flag.Int(
+		"concurrency",
+		routeConcurrency,
+		"Workers per subscription, metadata 'concurrency' overrides",
+	)
+	var maxInflight = flag.Int(
+		"maxinflight",
+		routeMaxInflight,
+		"Requests in flight per subscription before dropping, metadata 'max_inflight' overrides",
+	)
+	var pendingMsgs = flag.Int(
+		"pendingmsgs",
+		pendingMsgsLimit,
+		"NATS pending message limit per subscription, -1 for no limit",
+	)
+	var pendingBytes = flag.Int(
+		"pendingbytes",
+		pendingBytesLimit,
+		"NATS pending bytes limit per subscription, -1 for no limit",
+	)
+	var aggSubj = flag.String(
+		"aggsubj",
+		aggregateSubject,
+		"Subject to answer with the merged metrics of all routes, empty to disable",
+	)
+	var aggLabel = flag.String(
+		"agglabel",
+		aggregateLabel,
+		"Label naming the exporter of each series on the aggregate subject",
+	)
+	var healthEvery = flag.Duration(
+		"healthinterval",
+		healthInterval,
+		"Interval to health check exporter routes, 0 to disable",
+	)
+	var healthWait = flag.Duration(
+		"healthtimeout",
+		healthTimeout,
+		"Timeout for an exporter health check",
+	)
+	var instance = flag.String(
+		"instance",
+		instanceName,
+		"Instance name reported on replies, defaults to hostname",
 	)
 	var listenAddress = flag.String(
 		"listen",
@@ -247,14 +654,93 @@ func main() {
 	if topicFmt != *baseFmt {
 		topicFmt = *baseFmt
 	}
+	tmpl, err := parseSubjectFormat(topicFmt)
+	if err != nil {
+		logger.Fatal("-subjfmt: %v", err)
+	}
+	subjectTemplate = tmpl
+	if *portMapFile != "" {
+		ports, err := loadStringMap(*portMapFile)
+		if err != nil {
+			logger.Fatal("-portmap: %v", err)
+		}
+		for port, name := range ports {
+			exporterPorts[port] = name
+		}
+	}
+	if *subjMapFile != "" {
+		subjectOverrides, err = loadSubjectOverrides(*subjMapFile)
+		if err != nil {
+			logger.Fatal("-subjmap: %v", err)
+		}
+		logger.Info("Loaded %d subject overrides from [%v]", len(subjectOverrides), *subjMapFile)
+	}
 	if *remoteWrite != "" {
 		topicRemoteWrite = *remoteWrite
 	}
+	scrapeEncodings = *acceptEncodings
+	if *rwEncoding != "" {
+		if err := checkRemoteWriteEncoding(*rwEncoding, false); err != nil {
+			logger.Fatal("-rwencoding: %v", err)
+		}
+		remoteWriteEncoding = *rwEncoding
+	}
+	remoteWriteQueueSize = *rwQueue
+	if remoteWriteQueueSize < 1 {
+		logger.Fatal("-rwqueue must be at least 1")
+	}
+	remoteWriteMaxRetries = *rwRetries
+	remoteWriteRetryBudget = *rwRetryBudget
+	remoteWriteMinBackoff = *rwMinBackoff
+	remoteWriteMaxBackoff = *rwMaxBackoff
+	if remoteWriteMinBackoff > remoteWriteMaxBackoff {
+		logger.Fatal("-rwminbackoff must not be larger than -rwmaxbackoff")
+	}
+	spoolDir = *spoolDirectory
+	spoolMaxBytes = *spoolMax
+	spoolSegmentBytes = *spoolSegment
+	spoolRetryInterval = *spoolRetry
+	jsStream = *jetStream
+	if spoolDir != "" && jsStream != "" {
+		logger.Fatal("-spooldir cannot be used with -jsstream")
+	}
+	jsDurable = *jetStreamDurable
+	jsMaxDeliver = *jetStreamMaxDeliver
+	jsAckWait = *jetStreamAckWait
+	jsBackoff, err = parseDurations(*jetStreamBackoff)
+	if err != nil {
+		logger.Fatal("-jsbackoff: %v", err)
+	}
+	if jsAckWait <= 0 {
+		logger.Fatal("-jsackwait must be positive")
+	}
+	discoverySubject = *discoverySubj
+	discoveryWait = *discoveryTimeout
+	heartbeatInterval = *heartbeatEvery
+	targetParam = *targetParamName
+	queueGroup = *queueName
+	instanceName = *instance
+	scrapeCoalesce = *coalesceWindow
+	routeConcurrency = *concurrency
+	routeMaxInflight = *maxInflight
+	pendingMsgsLimit = *pendingMsgs
+	pendingBytesLimit = *pendingBytes
+	aggregateSubject = *aggSubj
+	aggregateLabel = *aggLabel
+	healthInterval = *healthEvery
+	healthTimeout = *healthWait
+
+	// Check target resolution order
+	order, err := parseTargetOrder(*targetOrderList)
+	if err != nil {
+		logger.Fatal("-targetorder: %v", err)
+	}
+	targetOrder = order
 
 	// Open subscription config file
 	// subscriptionRules := "subscriptions.json"
 	var exporterSub []models.Subscription
-	_, err := os.Stat(*natsSubs)
+	_, err = os.Stat(*natsSubs)
 
 	if err != nil {
 		logger.Info("No subscription file skipping any subscriptions")
@@ -279,6 +765,15 @@ func main() {
 		}
 	}
 
+	// Load `/probe` mapping table if set
+	if *probeMapFile != "" {
+		probeMap, err = loadProbeMap(*probeMapFile)
+		if err != nil {
+			logger.Fatal("%v", err)
+		}
+		logger.Info("Loaded %d probe mappings from [%v]", len(probeMap), *probeMapFile)
+	}
+
 	// Connect Options.
 	opts := []nats.Option{nats.Name(BuildName)}
 	opts = setupConnOptions(opts)
@@ -320,89 +815,179 @@ func main() {
 	logger.Info("Connection successful to [%v]", string(*natsUrls))
 	pubsubConn := ProxyContext(nc)
 
+	// Remote write through JetStream, the stream has to exist already
+	if jsStream != "" {
+		pubsubConn.js, err = nc.JetStream()
+		if err != nil {
+			logger.Fatal("%v", err)
+		}
+		if _, err := pubsubConn.js.StreamInfo(jsStream); err != nil {
+			logger.Fatal("-jsstream [%v]: %v", jsStream, err)
+		}
+		logger.Info("Remote write through JetStream stream [%v]", jsStream)
+	}
+
 	// https://go.dev/tour/flowcontrol/12
 	// https://go.dev/tour/flowcontrol/13
 	defer nc.Close()
 
 	// Get an array of subscriptions
 	for i := 0; i < len(exporterSub); i++ {
-		// Get the topic we're going to subscribe to
-		topicMap[exporterSub[i].Topic] = exporterSub[i].Route.Default
-		_, err := nc.Subscribe(
-			exporterSub[i].Topic,
-			func(msg *nats.Msg) {
-				if showDebug {
-					logger.Debug(
-						"incoming message for relay on [%v] to endpoint [%v]",
-						msg.Subject,
-						topicMap[msg.Subject],
-					)
-				}
-
-				reply, err := ProxyPrometheusRequest(
-					msg.Subject,
-					topicMap[msg.Subject],
-					string(msg.Data),
-				)
-				if err != nil {
-					logger.Error("Error on response: [%v]", err)
-				}
-				msg.Respond([]byte(reply))
-			},
+		// Get the topic we're going to subscribe to and compile route rules
+		route, err := newExporterRoute(exporterSub[i])
+		if err != nil {
+			logger.Fatal("%v", err)
+		}
+		topicMap[exporterSub[i].Topic] = route
+		handler := pubsubConn.startWorkers(
+			route.sub.Topic,
+			route.concurrency,
+			route.maxInflight,
+			pubsubConn.ExporterRequestHandler,
 		)
 
+		// With a queue group only one ambassador in the group gets each
+		// request, for redundant ambassadors in front of the same exporter
+		var sub *nats.Subscription
+		if route.queue != "" {
+			sub, err = nc.QueueSubscribe(
+				exporterSub[i].Topic,
+				route.queue,
+				handler,
+			)
+		} else {
+			sub, err = nc.Subscribe(
+				exporterSub[i].Topic,
+				handler,
+			)
+		}
+		if err == nil {
+			err = sub.SetPendingLimits(pendingMsgsLimit, pendingBytesLimit)
+		}
+
 		if err != nil {
 			logger.Error("%v", err)
 		} else {
 			logger.Info(
-				"subscribed to [%v], with endpoint [%v]",
+				"subscribed to [%v] queue [%v], with endpoint [%v], %d rules and %d workers",
 				exporterSub[i].Topic,
+				route.queue,
 				exporterSub[i].Route.Default,
+				len(exporterSub[i].Route.Rules),
+				route.concurrency,
 			)
 		}
 	}
 
+	// Answer service discovery requests with the topics we serve
+	if len(topicMap) > 0 {
+		_, err := nc.Subscribe(discoverySubject, pubsubConn.DiscoveryRequestHandler)
+		if err != nil {
+			logger.Error("%v", err)
+		} else {
+			logger.Info("subscribed to discovery [%v]", discoverySubject)
+		}
+
+		// Announce at startup and then on every heartbeat
+		if heartbeatInterval > 0 {
+			go pubsubConn.runHeartbeat(heartbeatInterval)
+		}
+
+		// One subject for the metrics of every route
+		if aggregateSubject != "" {
+			if err := checkAggregateNames(topicMap); err != nil {
+				logger.Fatal("%v", err)
+			}
+			handler := pubsubConn.startWorkers(
+				aggregateSubject,
+				routeConcurrency,
+				routeMaxInflight,
+				pubsubConn.AggregateRequestHandler,
+			)
+			sub, err := nc.Subscribe(aggregateSubject, handler)
+			if err == nil {
+				err = sub.SetPendingLimits(pendingMsgsLimit, pendingBytesLimit)
+			}
+			if err != nil {
+				logger.Error("%v", err)
+			} else {
+				logger.Info("subscribed to aggregate [%v]", aggregateSubject)
+			}
+		}
+
+		// Fail requests fast for exporters that are down
+		if healthInterval > 0 {
+			go pubsubConn.runHealthChecks(healthInterval)
+		}
+	}
+
+	// Keep track of heartbeats from exporter side ambassadors
+	_, err = nc.Subscribe(heartbeatSubject(), pubsubConn.HeartbeatHandler)
+	if err != nil {
+		logger.Error("%v", err)
+	}
+
 	// Check if `-remotewrite` is set and use the `subjbase` to subscribe with
 	// this is to avoid using the subscription file used in the req/reply method
 	// that did dynamic creation of NATS subjects. In the remote write scenario
 	// there is only one subscription that happens on the specified base target
 	if topicRemoteWrite != "" {
-		_, err := nc.Subscribe(
-			topicBase,
-			func(msg *nats.Msg) {
-				if showDebug {
-					logger.Debug(
-						"incoming message for relay on [%v] to endpoint [%v]",
-						msg.Subject,
-						topicRemoteWrite,
-					)
-				}
+		targets, err := parseRemoteWriteTargets(topicRemoteWrite)
+		if err != nil {
+			logger.Fatal("-remotewrite: %v", err)
+		}
 
-				_, err := RelayPrometheusRemoteWrite(
-					msg.Subject,
-					topicRemoteWrite,
-					msg.Data,
-				)
-				if err != nil {
-					logger.Error("Error on response: [%v]", err)
+		if pubsubConn.js != nil {
+			_, err = pubsubConn.subscribeRemoteWriteJetStream(targets)
+		} else {
+			var queues []*remoteWriteQueue
+			for _, target := range targets {
+				q := newRemoteWriteQueue(target, func(msg *nats.Msg) error {
+					_, err := RelayPrometheusRemoteWrite(msg.Subject, target, msg.Header, msg.Data)
+					return err
+				})
+				if spoolDir != "" {
+					st, err := newSpooledTarget(target)
+					if err != nil {
+						logger.Fatal("-spooldir: %v", err)
+					}
+					go st.replay(nil)
+					q.deliver = st.add
 				}
-			},
-		)
+				go q.run()
+				queues = append(queues, q)
+			}
+			_, err = nc.Subscribe(
+				topicBase,
+				func(msg *nats.Msg) {
+					for _, q := range queues {
+						q.push(msg)
+					}
+				},
+			)
+		}
 
 		if err != nil {
 			logger.Error("%v", err)
 		} else {
-			logger.Info(
-				"subscribed to [%v], with endpoint [%v]",
-				topicBase,
-				topicRemoteWrite,
-			)
+			for _, target := range targets {
+				logger.Info(
+					"subscribed to [%v], with endpoint [%v] encoding [%v] protocol [%v]",
+					topicBase,
+					target.URL,
+					target.Encoding,
+					target.Protocol,
+				)
+			}
 		}
 	}
 
 	// Prepare HTTP handlers
 	http.Handle("/metrics", promhttp.Handler())
 	http.HandleFunc("/proxy", pubsubConn.ProxyRequestHandler)
+	http.HandleFunc("/proxy/", pubsubConn.ProxyRequestHandler)
+	http.HandleFunc("/probe", pubsubConn.ProbeRequestHandler)
+	http.HandleFunc("/sd", pubsubConn.ServiceDiscoveryHandler)
 	http.HandleFunc("/api/v1/write", pubsubConn.RemoteWriteHandler)
 	log.Fatal(http.ListenAndServe(*listenAddress, nil))
 }
@@ -419,6 +1004,7 @@ func setupConnOptions(opts []nats.Option) []nats.Option {
 	opts = append(opts, nats.ReconnectHandler(func(nc *nats.Conn) {
 		logger.Warn("Reconnected [%s]", nc.ConnectedUrl())
 	}))
+	opts = append(opts, nats.ErrorHandler(natsErrorHandler))
 	opts = append(opts, nats.ClosedHandler(func(nc *nats.Conn) {
 		logger.Fatal("Exiting: %v", nc.LastError())
 	}))
@@ -0,0 +1,143 @@
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	dto "github.com/prometheus/client_model/go"
+	"google.golang.org/protobuf/proto"
+
+	"github.com/insikl/prometheus-nats-ambassador/internal/models"
+	"github.com/insikl/prometheus-nats-ambassador/internal/relabel"
+)
+
+// Series Prometheus would drop anyway do not need to cross the WAN. Routes with
+// `metric_relabel_configs` or `static_labels` have the exporter reply parsed,
+// relabeled and encoded again in the format the scraper asked for before it
+// goes over NATS.
+type replyRelabel struct {
+	configs []*relabel.Config
+	static  map[string]string
+}
+
+// Placeholders available in `static_labels` values
+var staticLabelVars = map[string]func() string{
+	"${instance}": func() string { return instanceName },
+	"${hostname}": func() string { return ambassadorHostname },
+}
+
+// Compile the relabel settings of a subscription, nil when there are none
+func newReplyRelabel(sub models.Subscription) (*replyRelabel, error) {
+	if len(sub.MetricRelabelConfigs) == 0 && len(sub.StaticLabels) == 0 {
+		return nil, nil
+	}
+	configs, err := relabel.NewConfigs(sub.MetricRelabelConfigs)
+	if err != nil {
+		return nil, err
+	}
+	for name := range sub.StaticLabels {
+		if !relabel.ValidLabelName(name) || name == relabel.MetricName {
+			return nil, fmt.Errorf("invalid static label %q", name)
+		}
+	}
+	return &replyRelabel{configs: configs, static: sub.StaticLabels}, nil
+}
+
+// Relabel an exporter reply in place. `accept` is the scraper `Accept` header
+// used to pick the format it is encoded with again. Error replies are left as
+// they are.
+//
+// Unlike Prometheus, `__name__` is the family name, so a histogram or summary
+// is kept or dropped as a whole and `_bucket`, `_sum` and `_count` can not be
+// matched on their own. Renaming a series in to a family of another type fails
+// the reply, the result could not be encoded. So does a `__name__` that is not
+// a valid metric name.
+func (rl *replyRelabel) apply(topic string, reply *exporterReply, accept string) error {
+	if reply.Status < 200 || reply.Status > 299 {
+		return nil
+	}
+
+	parsed, err := decodeFamilies(reply)
+	if err != nil {
+		return err
+	}
+
+	// Text decoding has no fixed family order, sorted so families merged by a
+	// rename come out the same every time
+	sort.Slice(parsed, func(i, j int) bool {
+		return parsed[i].GetName() < parsed[j].GetName()
+	})
+
+	// Metrics are moved between families when `__name__` is changed
+	families := make(map[string]*dto.MetricFamily)
+	dropped := 0
+	for _, mf := range parsed {
+		for _, m := range mf.GetMetric() {
+			labels := make(map[string]string, len(m.GetLabel())+len(rl.static)+1)
+			for _, lp := range m.GetLabel() {
+				labels[lp.GetName()] = lp.GetValue()
+			}
+			for name, value := range rl.static {
+				for v, fn := range staticLabelVars {
+					value = strings.ReplaceAll(value, v, fn())
+				}
+				labels[name] = value
+			}
+			labels[relabel.MetricName] = mf.GetName()
+
+			if !relabel.Process(labels, rl.configs) || labels[relabel.MetricName] == "" {
+				dropped++
+				continue
+			}
+			name := labels[relabel.MetricName]
+			if !relabel.ValidMetricName(name) {
+				return fmt.Errorf("relabeling %v %q gives invalid metric name %q",
+					mf.GetType(), mf.GetName(), name)
+			}
+			delete(labels, relabel.MetricName)
+
+			setLabels(m, labels)
+
+			out, ok := families[name]
+			if ok && out.GetType() != mf.GetType() {
+				return fmt.Errorf("relabeling %v %q merges it in to %v %q",
+					mf.GetType(), mf.GetName(), out.GetType(), name)
+			}
+			if !ok {
+				out = &dto.MetricFamily{
+					Name: proto.String(name),
+					Help: mf.Help,
+					Type: mf.Type,
+					Unit: mf.Unit,
+				}
+				families[name] = out
+			}
+			out.Metric = append(out.Metric, m)
+		}
+	}
+	if dropped > 0 {
+		relabelDropped.WithLabelValues(topic).Add(float64(dropped))
+	}
+
+	body, format, err := encodeFamilies(families, accept)
+	if err != nil {
+		return err
+	}
+	reply.Body = body
+	reply.Header.Set("Content-Type", string(format))
+	reply.Header.Del("Content-Encoding")
+	reply.Header.Del("Content-Length")
+	return nil
+}
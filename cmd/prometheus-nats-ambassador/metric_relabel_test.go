@@ -0,0 +1,132 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/insikl/prometheus-nats-ambassador/internal/models"
+)
+
+// Test an exporter reply is relabeled and encoded in the negotiated format
+func TestReplyRelabel(t *testing.T) {
+	drop := "go_.*"
+	rl, err := newReplyRelabel(models.Subscription{
+		MetricRelabelConfigs: []models.RelabelConfig{
+			{SourceLabels: []string{"__name__"}, Regex: &drop, Action: "drop"},
+		},
+		StaticLabels: map[string]string{"site": "dc1"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	accept := "application/openmetrics-text;version=1.0.0,text/plain;q=0.5"
+	if got := parseableAccept(accept); got != "text/plain;version=0.0.4" {
+		t.Errorf("exporter accept %q", got)
+	}
+
+	hdr := http.Header{}
+	hdr.Set("Content-Type", "text/plain; version=0.0.4")
+	reply := &exporterReply{
+		Status: http.StatusOK,
+		Header: hdr,
+		Body: []byte(`# HELP go_goroutines Goroutines.
+# TYPE go_goroutines gauge
+go_goroutines 8
+# HELP up Up.
+# TYPE up gauge
+up{job="node"} 1
+`),
+	}
+	if err := rl.apply("test", reply, "text/plain"); err != nil {
+		t.Fatal(err)
+	}
+	want := `# HELP up Up.
+# TYPE up gauge
+up{job="node",site="dc1"} 1
+`
+	if string(reply.Body) != want {
+		t.Errorf("got:\n%s\nwant:\n%s", reply.Body, want)
+	}
+}
+
+// Test renames can not merge families of different types
+func TestReplyRelabelMerge(t *testing.T) {
+	regex, replacement := "requests_.*", "requests"
+	rl, err := newReplyRelabel(models.Subscription{
+		MetricRelabelConfigs: []models.RelabelConfig{
+			{
+				SourceLabels: []string{"__name__"},
+				Regex:        &regex,
+				TargetLabel:  "__name__",
+				Replacement:  &replacement,
+				Action:       "replace",
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	newReply := func(body string) *exporterReply {
+		hdr := http.Header{}
+		hdr.Set("Content-Type", "text/plain; version=0.0.4")
+		return &exporterReply{Status: http.StatusOK, Header: hdr, Body: []byte(body)}
+	}
+
+	// Same type, merged in to one family
+	reply := newReply(`# TYPE requests_a counter
+requests_a{code="200"} 1
+# TYPE requests_b counter
+requests_b{code="500"} 2
+`)
+	if err := rl.apply("test", reply, "text/plain"); err != nil {
+		t.Fatal(err)
+	}
+	want := `# TYPE requests counter
+requests{code="200"} 1
+requests{code="500"} 2
+`
+	if string(reply.Body) != want {
+		t.Errorf("got:\n%s\nwant:\n%s", reply.Body, want)
+	}
+
+	reply = newReply(`# TYPE requests_a counter
+requests_a 1
+# TYPE requests_b gauge
+requests_b 2
+`)
+	if err := rl.apply("test", reply, "text/plain"); err == nil {
+		t.Errorf("expected error merging a gauge in to a counter, got:\n%s", reply.Body)
+	}
+}
+
+// Test label and metric names that can not be encoded are rejected
+func TestReplyRelabelInvalid(t *testing.T) {
+	for _, name := range []string{"", "__name__", "dc-1", "0site"} {
+		if _, err := newReplyRelabel(models.Subscription{StaticLabels: map[string]string{name: "x"}}); err == nil {
+			t.Errorf("expected error for static label %q", name)
+		}
+	}
+	if _, err := newReplyRelabel(models.Subscription{
+		MetricRelabelConfigs: []models.RelabelConfig{{TargetLabel: "dc-1"}},
+	}); err == nil {
+		t.Errorf("expected error for invalid target_label")
+	}
+
+	replacement := "node-load"
+	rl, err := newReplyRelabel(models.Subscription{
+		MetricRelabelConfigs: []models.RelabelConfig{
+			{TargetLabel: "__name__", Replacement: &replacement},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	hdr := http.Header{}
+	hdr.Set("Content-Type", "text/plain; version=0.0.4")
+	reply := &exporterReply{Status: http.StatusOK, Header: hdr, Body: []byte("node_load1 1\n")}
+	if err := rl.apply("test", reply, "text/plain"); err == nil {
+		t.Errorf("expected error for invalid metric name, got:\n%s", reply.Body)
+	}
+}
@@ -0,0 +1,118 @@
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"regexp"
+
+	"github.com/insikl/prometheus-nats-ambassador/internal/logger"
+	"github.com/insikl/prometheus-nats-ambassador/internal/models"
+)
+
+type probeMapping struct {
+	target     *regexp.Regexp
+	module     *regexp.Regexp
+	ambassador string
+}
+
+// Mapping table loaded from `-probemap`, first match wins
+var probeMap []probeMapping
+
+// Load the `/probe` mapping table from a JSON file
+func loadProbeMap(file string) ([]probeMapping, error) {
+	byteValue, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var entries []models.ProbeMapping
+	if err := json.Unmarshal(byteValue, &entries); err != nil {
+		return nil, err
+	}
+
+	var mappings []probeMapping
+	for i, e := range entries {
+		if e.Ambassador == "" {
+			return nil, fmt.Errorf("probe map entry %d: missing ambassador", i)
+		}
+		m := probeMapping{ambassador: e.Ambassador}
+		// Anchored the same as Prometheus relabel regex
+		if e.Target != "" {
+			if m.target, err = regexp.Compile("^(?:" + e.Target + ")$"); err != nil {
+				return nil, fmt.Errorf("probe map entry %d: %w", i, err)
+			}
+		}
+		if e.Module != "" {
+			if m.module, err = regexp.Compile("^(?:" + e.Module + ")$"); err != nil {
+				return nil, fmt.Errorf("probe map entry %d: %w", i, err)
+			}
+		}
+		mappings = append(mappings, m)
+	}
+	return mappings, nil
+}
+
+// Find the ambassador for a target/module from the mapping table
+func lookupProbeAmbassador(target, module string) string {
+	for _, m := range probeMap {
+		if m.target != nil && !m.target.MatchString(target) {
+			continue
+		}
+		if m.module != nil && !m.module.MatchString(module) {
+			continue
+		}
+		return m.ambassador
+	}
+	return ""
+}
+
+// HTTP handler function for `/probe` endpoint, multi-target exporters such as
+// blackbox_exporter and snmp_exporter have the real target in `?target=`, so
+// the ambassador to send to is picked by the `-targetparam` param (default
+// `ambassador=host:port`), the mapping table, then the rest of `-targetorder`.
+// The rest of the params (`target`, `module`) are passed on unchanged.
+//
+// Example: /probe?ambassador=site1:9115&module=icmp&target=10.1.2.3
+func (pubsub *ProxyConn) ProbeRequestHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+
+	ambassador := q.Get(targetParam)
+	q.Del(targetParam)
+	if ambassador == "" {
+		ambassador = lookupProbeAmbassador(q.Get("target"), q.Get("module"))
+	}
+
+	var hostName, hostPort string
+	var err error
+	if ambassador != "" {
+		hostName, hostPort, err = splitTarget(ambassador, "")
+	} else {
+		hostName, hostPort, err = resolveTarget(r)
+	}
+	if err != nil {
+		logger.Error("%v", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	subj, err := hostSubject(hostName, hostPort, q)
+	if err != nil {
+		logger.Error("%v", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	pubsub.proxyScrape(w, r, subj, "/probe", q)
+}
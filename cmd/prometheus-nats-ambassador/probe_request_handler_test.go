@@ -0,0 +1,76 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func writeProbeMap(t *testing.T, data string) string {
+	t.Helper()
+	file := filepath.Join(t.TempDir(), "probemap.json")
+	if err := os.WriteFile(file, []byte(data), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+// Test the probe map picks the first matching entry with anchored regex
+func TestLookupProbeAmbassador(t *testing.T) {
+	defer func(m []probeMapping) { probeMap = m }(probeMap)
+
+	var err error
+	probeMap, err = loadProbeMap(writeProbeMap(t, `[
+		{"target": "10\\.1\\..*", "module": "icmp", "ambassador": "site1:9115"},
+		{"target": "10\\.1\\..*", "ambassador": "site1-all:9115"},
+		{"module": "snmp_.*", "ambassador": "snmp:9116"},
+		{"target": "host|10\\.2\\.0\\.1", "ambassador": "site2:9115"}
+	]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		target, module string
+		want           string
+	}{
+		{"10.1.2.3", "icmp", "site1:9115"},
+		{"10.1.2.3", "http_2xx", "site1-all:9115"},
+		{"10.3.0.1", "snmp_if_mib", "snmp:9116"},
+		{"10.2.0.1", "icmp", "site2:9115"},
+		{"host", "", "site2:9115"},
+		// Anchored, partial matches do not count
+		{"110.1.2.3", "icmp", ""},
+		{"10.2.0.12", "icmp", ""},
+		{"myhost", "", ""},
+		{"10.3.0.1", "xsnmp_if_mib", ""},
+	}
+	for _, tt := range tests {
+		if got := lookupProbeAmbassador(tt.target, tt.module); got != tt.want {
+			t.Errorf("lookupProbeAmbassador(%q, %q) = %q, want %q", tt.target, tt.module, got, tt.want)
+		}
+	}
+
+	// An empty entry matches anything
+	probeMap, _ = loadProbeMap(writeProbeMap(t, `[{"ambassador": "default:9115"}]`))
+	if got := lookupProbeAmbassador("anything", "any"); got != "default:9115" {
+		t.Errorf("got %q, want default:9115", got)
+	}
+}
+
+// Test broken probe maps are rejected
+func TestLoadProbeMapInvalid(t *testing.T) {
+	for name, data := range map[string]string{
+		"json":       `[{"ambassador": "site1:9115"`,
+		"ambassador": `[{"target": "10\\..*"}]`,
+		"target":     `[{"target": "(", "ambassador": "site1:9115"}]`,
+		"module":     `[{"module": "[", "ambassador": "site1:9115"}]`,
+	} {
+		if _, err := loadProbeMap(writeProbeMap(t, data)); err == nil {
+			t.Errorf("%s: expected error", name)
+		}
+	}
+	if _, err := loadProbeMap(filepath.Join(t.TempDir(), "missing.json")); err == nil {
+		t.Errorf("expected error for a missing file")
+	}
+}
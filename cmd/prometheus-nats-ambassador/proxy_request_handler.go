@@ -23,126 +23,430 @@ import (
 	"time"
 
 	"github.com/insikl/prometheus-nats-ambassador/internal/logger"
+	"github.com/nats-io/nats.go"
 	"github.com/prometheus/client_golang/prometheus"
 )
 
-// HTTP handler function for `/proxy` endpoint
-func (pubsub *ProxyConn) ProxyRequestHandler(w http.ResponseWriter, r *http.Request) {
-	// Start timer
-	start := time.Now()
+// NATS message headers used between scraper and exporter side ambassadors. The
+// body of the request is still the query string so older versions continue to
+// work with each other.
+const (
+	// Path requested after `/proxy`, used by route rules
+	hdrPath = "X-Ambassador-Path"
+	// HTTP status returned by the exporter or the exporter side ambassador
+	hdrStatus = "X-Ambassador-Status"
+	// Description of an error on the exporter side
+	hdrError = "X-Ambassador-Error"
+	// Exporter side ambassador that served the request
+	hdrInstance = "X-Ambassador-Instance"
+)
 
-	// https://go.dev/ref/spec#Expression_switches
-	hostReqRaw := r.Header.Get("x-forwarded-host")
-	switch hostReqRaw {
-	case "":
-		hostReqRaw = r.Host
-	default:
-		logger.Fatal("No host defined, unable to continue")
-	}
+// Hop-by-hop and credential headers that are not forwarded over NATS
+// https://www.rfc-editor.org/rfc/rfc9110#section-7.6.1
+var skipForwardHeaders = map[string]bool{
+	"Connection":          true,
+	"Keep-Alive":          true,
+	"Proxy-Connection":    true,
+	"Proxy-Authenticate":  true,
+	"Proxy-Authorization": true,
+	"Te":                  true,
+	"Trailer":             true,
+	"Transfer-Encoding":   true,
+	"Upgrade":             true,
+	"Authorization":       true,
+	"Cookie":              true,
+}
 
-	promScrapeTimeoutRaw, err := strconv.Atoi(r.Header.Get("x-prometheus-scrape-timeout-seconds"))
-	if err != nil {
-		// Unable to convert string to int, default to 10 seconds.
-		promScrapeTimeoutRaw = 10
+// Copy the incoming HTTP request headers in to NATS message headers so the
+// exporter side can match route rules against them and pass on the `Accept`
+// header for content negotiation with the exporter.
+func forwardHeaders(r *http.Request) nats.Header {
+	hdr := nats.Header{}
+	for k, v := range r.Header {
+		if skipForwardHeaders[http.CanonicalHeaderKey(k)] {
+			continue
+		}
+		hdr[k] = append([]string(nil), v...)
 	}
-	// Set NATS timeout on request
-	// https://pkg.go.dev/time#Second
-	promScrapeTimeout := time.Duration(promScrapeTimeoutRaw) * time.Second
-
-	// Normalize hostname to lowercase
-	hostReq := strings.ToLower(hostReqRaw)
+	return hdr
+}
 
-	if hostReq == "" {
+// HTTP handler function for `/proxy` endpoint
+func (pubsub *ProxyConn) ProxyRequestHandler(w http.ResponseWriter, r *http.Request) {
+	hostName, hostPort, err := resolveTarget(r)
+	if err != nil {
 		// https://prometheus.io/docs/instrumenting/writing_exporters/#failed-scrapes
 		// https://go.dev/src/net/http/status.go
-		w.Header().Set("Content-Type", "text/html")
-		w.WriteHeader(http.StatusBadGateway)
-		w.Write([]byte(`<html>
-		    <head><title>Prometheus NATS Ambassador</title></head>
-			<body><b>ERROR: missing Host parameter</b></body>
-			</html>`))
+		logger.Error("%v", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
+	// Explicit target param is only for us, not the exporter
+	q := r.URL.Query()
+	q.Del(targetParam)
 
-	// Get request and findout NATS subject we'll send requests to
-	hostName, hostPort, err := net.SplitHostPort(hostReq)
+	subj, err := hostSubject(hostName, hostPort, q)
 	if err != nil {
 		logger.Error("%v", err)
-		// https://go.dev/src/net/http/status.go
-		w.WriteHeader(http.StatusBadGateway)
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	// Check if we couldn't split, set `hostName` to `Host: <...>` and default
-	// to port `80`.
-	if hostName == "" && hostPort == "" {
-		hostName = hostReq
-		hostPort = strconv.Itoa(80)
-	}
+	// Anything after `/proxy` is passed along for route rules to match on,
+	// example `/proxy/metrics/cadvisor` sends the path `/metrics/cadvisor`
+	fwdPath := strings.TrimPrefix(r.URL.Path, "/proxy")
 
-	// Normalize hostname, create array of hostname in forward and reverse.
-	hostFwd := strings.Split(hostName, ".")
+	pubsub.proxyScrape(w, r, subj, fwdPath, q)
+}
 
-	// Reverse hostname
-	var hostRev []string
-	for _, n := range hostFwd {
-		hostRev = append([]string{n}, hostRev...)
-	}
+// Send the scrape over NATS to `subj` and write the reply back to Prometheus.
+// The query params `q` are sent as the body and `fwdPath` for route rules.
+func (pubsub *ProxyConn) proxyScrape(
+	w http.ResponseWriter,
+	r *http.Request,
+	subj string,
+	fwdPath string,
+	q url.Values,
+) {
+	// Start timer
+	start := time.Now()
 
-	// var subFormat string
-	switch topicFmt {
-	case "rev":
-		hostName = strings.Join(hostRev, ".")
-	case "fwd":
-		hostName = strings.Join(hostFwd, ".")
-	default:
-		hostName = strings.ReplaceAll(hostName, ".", "_")
+	promScrapeTimeoutRaw, err := strconv.Atoi(r.Header.Get("x-prometheus-scrape-timeout-seconds"))
+	if err != nil {
+		// Unable to convert string to int, default to 10 seconds.
+		promScrapeTimeoutRaw = 10
 	}
+	// Set NATS timeout on request
+	// https://pkg.go.dev/time#Second
+	promScrapeTimeout := time.Duration(promScrapeTimeoutRaw) * time.Second
 
-	// Build NATS subject
-	subj := topicBase + hostName + "." + hostPort
+	// Identical scrapes share a NATS request, the timeout is left out so
+	// Prometheus servers with different timeouts still match
+	params := q.Encode()
 
 	// https://pkg.go.dev/net/http#Request.URL
-	q := r.URL.Query()
-	q.Add("x-prometheus-scrape-timeout-seconds", strconv.Itoa(promScrapeTimeoutRaw))
-	r.URL.RawQuery = q.Encode()
-	payload := []byte(r.URL.RawQuery)
-	msg, err := pubsub.nc.Request(subj, payload, promScrapeTimeout)
+	q.Set("x-prometheus-scrape-timeout-seconds", strconv.Itoa(promScrapeTimeoutRaw))
+	payload := []byte(q.Encode())
+
+	hdr := forwardHeaders(r)
+	if fwdPath != "" {
+		hdr.Set(hdrPath, fwdPath)
+	}
+	if scrapeEncodings != "" {
+		hdr.Set(hdrAcceptEncoding, scrapeEncodings)
+	}
+
+	key := coalesceKey(subj, fwdPath, params, r.Header.Get("Accept"), r.Header.Get("Accept-Encoding"))
+	msg, coalesced, err := coalescedRequest(r.Context(), key, promScrapeTimeout,
+		func(timeout time.Duration) (*nats.Msg, error) {
+			return pubsub.RequestReply(&nats.Msg{
+				Subject: subj,
+				Header:  hdr,
+				Data:    payload,
+			}, timeout)
+		})
+	if coalesced {
+		proxyCoalesced.WithLabelValues(subj).Inc()
+	}
 
 	if err != nil {
 		if pubsub.nc.LastError() != nil {
-			logger.Fatal("%v last error for request\n", pubsub.nc.LastError())
+			logger.Error("%v last error for request", pubsub.nc.LastError())
 		}
+		// Missing chunks means the exporter side answered but the reply did
+		// not make it through in full.
 		// https://go.dev/src/net/http/status.go
-		w.WriteHeader(http.StatusServiceUnavailable)
+		status := http.StatusServiceUnavailable
+		if errors.Is(err, errIncompleteReply) {
+			status = http.StatusBadGateway
+		}
+		w.WriteHeader(status)
 		logger.Error("%v on subject [%v], %v\n", err, subj, time.Since(start))
 
 		// Increase counter by one
 		proxyRequest.With(prometheus.Labels{
 			"subject": subj,
-			"code":    "503",
+			"code":    strconv.Itoa(status),
+		}).Inc()
+		return
+	}
+
+	reply, err := parseReplyMsg(msg)
+	if reply == nil {
+		logger.Error("%v on subject [%v]", err, subj)
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		proxyRequest.With(prometheus.Labels{
+			"subject": subj,
+			"code":    "502",
 		}).Inc()
 		return
 	}
+	if err != nil {
+		logger.Error("exporter error on subject [%v] status %d: %v", subj, reply.Status, err)
+	}
+	countServedBy(subj, msg)
+
+	// Hand compressed bytes straight to Prometheus when it accepts the
+	// encoding, only decompress when we have to.
+	if enc := reply.Header.Get("Content-Encoding"); enc != "" &&
+		!acceptsEncoding(r.Header.Get("Accept-Encoding"), enc) {
+		body, err := decodeBody(enc, reply.Body)
+		if err != nil {
+			logger.Error("%v on subject [%v]", err, subj)
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			proxyRequest.With(prometheus.Labels{
+				"subject": subj,
+				"code":    "502",
+			}).Inc()
+			return
+		}
+		reply.Body = body
+		reply.Header.Del("Content-Encoding")
+	}
 
 	// Increase counter by one
 	proxyRequest.With(prometheus.Labels{
 		"subject": subj,
-		"code":    "200",
+		"code":    strconv.Itoa(reply.Status),
 	}).Inc()
 
-	w.Header().Set("Content-Type", "text/plain")
-	w.Write(msg.Data)
+	// Return the exporter status and headers so Prometheus marks `up=0` on a
+	// real failure.
+	for k, v := range reply.Header {
+		w.Header()[k] = v
+	}
+	w.WriteHeader(reply.Status)
+	w.Write(reply.Body)
+}
+
+// NATS handler for requests on subscribed topics, fetch from the exporter and
+// reply with the result.
+func (pubsub *ProxyConn) ExporterRequestHandler(msg *nats.Msg) {
+	reqHeader := http.Header(msg.Header)
+
+	// Route for the subscription that got the message, this is the wildcard
+	// pattern for wildcard topics
+	route := lookupRoute(msg)
+	if route == nil {
+		err := fmt.Errorf("no route for subject %q", msg.Subject)
+		logger.Error("%v", err)
+		reply, _ := errorReply(msg.Subject, http.StatusNotFound, err)
+		pubsub.RespondReply(msg, newReplyMsg(reply, err))
+		return
+	}
+
+	// Pick endpoint from route rules, fallback to default
+	params, _ := url.ParseQuery(string(msg.Data))
+	endpoint, err := route.resolve(routeRequest{
+		Subject: msg.Subject,
+		Path:    reqHeader.Get(hdrPath),
+		Query:   params,
+		Header:  reqHeader,
+	})
+	if err != nil {
+		logger.Error("Error resolving route on [%v]: %v", msg.Subject, err)
+		reply, _ := errorReply(msg.Subject, http.StatusInternalServerError, err)
+		pubsub.RespondReply(msg, newReplyMsg(reply, err))
+		return
+	}
+
+	// Known dead exporter, fail now rather than wait for the timeout
+	if err := route.health.failFast(endpoint); err != nil {
+		reply, _ := errorReply(msg.Subject, http.StatusServiceUnavailable, err)
+		pubsub.RespondReply(msg, newReplyMsg(reply, err))
+		return
+	}
+
+	if showDebug {
+		logger.Debug(
+			"incoming message for relay on [%v] to endpoint [%v]",
+			msg.Subject,
+			endpoint,
+		)
+	}
+
+	// Relabeled routes only ask the exporter for formats that can be parsed
+	fetchHeader := reqHeader
+	if route.relabel != nil {
+		fetchHeader = reqHeader.Clone()
+		fetchHeader.Set("Accept", parseableAccept(reqHeader.Get("Accept")))
+	}
+	fetch := func() (*exporterReply, error) {
+		reply, err := ProxyPrometheusRequest(
+			msg.Subject,
+			endpoint,
+			string(msg.Data),
+			fetchHeader,
+			route,
+		)
+		if err == nil && route.relabel != nil {
+			if rerr := route.relabel.apply(msg.Subject, reply, reqHeader.Get("Accept")); rerr != nil {
+				return errorReply(msg.Subject, http.StatusBadGateway, rerr)
+			}
+		}
+		return reply, err
+	}
+	var reply *exporterReply
+	if route.cacheTTL > 0 {
+		key := cacheKey(msg.Subject, endpoint, params, reqHeader.Get("Accept"))
+		var hit bool
+		reply, hit, err = exporterCache.get(key, route.cacheTTL, fetch)
+		if hit {
+			cacheHits.WithLabelValues(msg.Subject).Inc()
+		} else {
+			cacheMisses.WithLabelValues(msg.Subject).Inc()
+		}
+	} else {
+		reply, err = fetch()
+	}
+	if err != nil {
+		logger.Error("Error on response: [%v]", err)
+	}
+
+	// Compress for the NATS hop with what the scraper side accepts
+	if reply != nil {
+		if cerr := compressReply(reply, reqHeader.Get(hdrAcceptEncoding)); cerr != nil {
+			logger.Error("Error compressing reply on [%v]: %v", msg.Subject, cerr)
+			reply, err = errorReply(msg.Subject, http.StatusBadGateway, cerr)
+		}
+	}
+
+	if err := pubsub.RespondReply(msg, newReplyMsg(reply, err)); err != nil {
+		logger.Error("Error sending reply on [%v]: %v", msg.Subject, err)
+	}
+}
+
+// Find the route for a message by the subscription it came in on, falls back
+// to the message subject when there is no subscription on the message.
+func lookupRoute(msg *nats.Msg) *exporterRoute {
+	if msg.Sub != nil {
+		if route, ok := topicMap[msg.Sub.Subject]; ok {
+			return route
+		}
+	}
+	return topicMap[msg.Subject]
+}
+
+// Reply from an exporter that gets sent back over NATS
+type exporterReply struct {
+	Status int
+	Header http.Header
+	Body   []byte
+}
+
+// Response headers from the exporter that are carried back over NATS
+var replyHeaders = []string{
+	"Content-Type",
+	"Content-Encoding",
+	"Age",
+	hdrCache,
+}
+
+// Count the reply against the exporter side ambassador that sent it, replies
+// from versions without the instance header are not counted
+func countServedBy(subj string, msg *nats.Msg) {
+	if instance := http.Header(msg.Header).Get(hdrInstance); instance != "" {
+		proxyServedBy.With(prometheus.Labels{
+			"subject":  subj,
+			"instance": instance,
+		}).Inc()
+	}
+}
+
+// Build the NATS reply message from an exporter reply. Errors are sent with a
+// 5xx status and the description in `X-Ambassador-Error` so the scraper side
+// can fail the scrape instead of returning an empty 200.
+func newReplyMsg(reply *exporterReply, err error) *nats.Msg {
+	if reply == nil {
+		reply = &exporterReply{Status: http.StatusBadGateway}
+	}
+
+	msg := &nats.Msg{Header: nats.Header{}, Data: reply.Body}
+	msg.Header.Set(hdrStatus, strconv.Itoa(reply.Status))
+	msg.Header.Set(hdrInstance, instanceName)
+	for _, k := range replyHeaders {
+		if v := reply.Header.Get(k); v != "" {
+			msg.Header.Set(k, v)
+		}
+	}
+	if err != nil {
+		// Header values cannot span lines
+		msg.Header.Set(hdrError, strings.Join(strings.Fields(err.Error()), " "))
+	}
+	return msg
+}
+
+// Decode a NATS reply message back into an exporter reply. Replies from
+// ambassadors before status headers were added are treated as 200 text/plain.
+func parseReplyMsg(msg *nats.Msg) (*exporterReply, error) {
+	reply := &exporterReply{
+		Status: http.StatusOK,
+		Header: http.Header{},
+		Body:   msg.Data,
+	}
+	reply.Header.Set("Content-Type", "text/plain")
+
+	hdr := http.Header(msg.Header)
+	if v := hdr.Get(hdrStatus); v != "" {
+		status, err := strconv.Atoi(v)
+		if err != nil || status < 100 || status > 999 {
+			return nil, fmt.Errorf("invalid status %q in reply", v)
+		}
+		reply.Status = status
+	}
+	for _, k := range replyHeaders {
+		if v := hdr.Get(k); v != "" {
+			reply.Header.Set(k, v)
+		}
+	}
+
+	if v := hdr.Get(hdrError); v != "" {
+		return reply, errors.New(v)
+	}
+	return reply, nil
+}
+
+// Pick a HTTP status for a failed request to an exporter
+func upstreamErrorStatus(err error) int {
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return http.StatusGatewayTimeout
+	}
+	return http.StatusBadGateway
+}
+
+// Reply with an error status and the error as a plain text body
+func errorReply(topic string, status int, err error) (*exporterReply, error) {
+	proxyReply.With(prometheus.Labels{
+		"subject": topic,
+		"code":    strconv.Itoa(status),
+	}).Inc()
+
+	hdr := http.Header{}
+	hdr.Set("Content-Type", "text/plain; charset=utf-8")
+	return &exporterReply{
+		Status: status,
+		Header: hdr,
+		Body:   []byte(err.Error() + "\n"),
+	}, err
+}
+
+// Request headers from the scraper that are passed on to the exporter. The
+// `Accept` header lets Prometheus negotiate OpenMetrics or protobuf exposition
+// for exemplars and native histograms.
+// https://prometheus.io/docs/instrumenting/content_negotiation/
+var exporterRequestHeaders = []string{
+	"Accept",
 }
 
 // NATS listen subscriber
-func ProxyPrometheusRequest(topic, urlHost, urlParam string) (string, error) {
+func ProxyPrometheusRequest(
+	topic, urlHost, urlParam string,
+	reqHeader http.Header,
+	route *exporterRoute,
+) (*exporterReply, error) {
 	if topic == "" {
-		proxyReply.With(prometheus.Labels{
-			"subject": topic,
-			"code":    "400",
-		}).Inc()
-		return "", errors.New("400 Bad Request no topic")
+		return errorReply(topic, http.StatusBadRequest, errors.New("400 Bad Request no topic"))
 	}
 
 	// Parse body of NATS message which is expected to be a query string
@@ -155,46 +459,113 @@ func ProxyPrometheusRequest(topic, urlHost, urlParam string) (string, error) {
 		timeoutScrape = 10
 	}
 
-	// Remove and rebuild query, even if `urlParam` is blank, not a big deal if
-	// URL ends with a `?`
+	// Remove and rebuild query, only append `?` if there is something to add
 	p.Del("x-prometheus-scrape-timeout-seconds")
 	urlParam = p.Encode()
-	urlReq := urlHost + "?" + urlParam
+
+	var auth *routeAuth
+	opts := defaultExecOptions
+	if route != nil {
+		auth, opts = route.auth, route.exec
+	}
+
+	// Collectors that are not HTTP servers
+	u, err := url.Parse(urlHost)
+	if err != nil {
+		return errorReply(topic, http.StatusInternalServerError,
+			fmt.Errorf("invalid endpoint %q: %w", urlHost, err))
+	}
+	var transport http.RoundTripper
+	switch u.Scheme {
+	case "file":
+		return fileRequest(topic, u)
+	case "exec":
+		return execRequest(topic, u, p, time.Duration(timeoutScrape)*time.Second, opts)
+	case "unix":
+		var sock string
+		sock, urlHost = unixSocketURL(u)
+		transport = unixTransport(sock)
+	}
+
+	urlReq := urlHost
+	if urlParam != "" {
+		// Route rules may already include query params, example blackbox
+		// exporter `http://localhost:9115/probe?module=icmp`
+		if strings.Contains(urlHost, "?") {
+			urlReq += "&" + urlParam
+		} else {
+			urlReq += "?" + urlParam
+		}
+	}
 
 	// Prepare rull URL request to pull from subscription rules
 	req, err := http.NewRequest(http.MethodGet, urlReq, nil)
 	if err != nil {
-		return "", fmt.Errorf("failed to create HTTP GET request: %w", err)
+		return errorReply(topic, http.StatusInternalServerError,
+			fmt.Errorf("failed to create HTTP GET request: %w", err))
 	}
 
 	// Set any headers and timeout, understood there could be an issue with the
 	// timeout as the same value is set in multiple places and weird race
 	// conditions can happen. HOWEVER, if an exporter is always close to max
 	// scrape timeout, that timeout should be increased on the scrapper.
-	req.Header.Set("Content-Type", "text/plain")
+	for _, k := range exporterRequestHeaders {
+		for _, v := range reqHeader.Values(k) {
+			req.Header.Add(k, v)
+		}
+	}
 	req.Header.Set("User-Agent", userAgent)
+	req.Header.Set("X-Prometheus-Scrape-Timeout-Seconds", strconv.Itoa(timeoutScrape))
+
+	// Setting `Accept-Encoding` stops the Go client decompressing the body, so
+	// a gzip reply from the exporter can pass through untouched when the
+	// scraper side accepts it.
+	if acceptsEncoding(reqHeader.Get(hdrAcceptEncoding), "gzip") {
+		req.Header.Set("Accept-Encoding", "gzip")
+	}
+	if err := auth.apply(req); err != nil {
+		return errorReply(topic, http.StatusInternalServerError, err)
+	}
+	if transport == nil {
+		transport, err = auth.roundTripper()
+		if err != nil {
+			return errorReply(topic, http.StatusInternalServerError, err)
+		}
+	}
 	client := http.Client{
-		Timeout: time.Duration(timeoutScrape) * time.Second,
+		Transport: transport,
+		Timeout:   time.Duration(timeoutScrape) * time.Second,
 	}
 	resp, err := client.Do(req)
 
 	if err != nil {
-		return "", fmt.Errorf("failed to send HTTP request: %w", err)
+		return errorReply(topic, upstreamErrorStatus(err),
+			fmt.Errorf("failed to send HTTP request: %w", err))
 	}
 
 	resBody, err := io.ReadAll(resp.Body)
 	resp.Body.Close()
 	if err != nil {
-		return "", fmt.Errorf("failed to read response body: %w", err)
+		return errorReply(topic, upstreamErrorStatus(err),
+			fmt.Errorf("failed to read response body: %w", err))
 	}
 
-	// Convert the byte body to type string
-	bodyString := string(resBody)
-
 	proxyReply.With(prometheus.Labels{
 		"subject": topic,
-		"code":    "200",
+		"code":    strconv.Itoa(resp.StatusCode),
 	}).Inc()
 
-	return bodyString, nil
+	reply := &exporterReply{
+		Status: resp.StatusCode,
+		Header: resp.Header,
+		Body:   resBody,
+	}
+
+	// Pass along the exporter error status and body as is, still flag it so
+	// it shows in the logs on both sides.
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return reply, fmt.Errorf("exporter returned non-success status: %s", resp.Status)
+	}
+
+	return reply, nil
 }
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/nats-io/nats.go"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// Test exporter replies survive the trip over NATS with status, headers and
+// error text
+func TestReplyMsg(t *testing.T) {
+	hdr := http.Header{}
+	hdr.Set("Content-Type", "application/openmetrics-text; version=1.0.0")
+	hdr.Set("Content-Encoding", "zstd")
+	hdr.Set("Set-Cookie", "not=carried")
+
+	tests := []struct {
+		name    string
+		reply   *exporterReply
+		err     error
+		want    *exporterReply
+		wantErr string
+	}{
+		{
+			name:  "ok",
+			reply: &exporterReply{Status: http.StatusOK, Header: hdr, Body: []byte("up 1\n")},
+			want: &exporterReply{Status: http.StatusOK, Header: http.Header{
+				"Content-Type":     {"application/openmetrics-text; version=1.0.0"},
+				"Content-Encoding": {"zstd"},
+			}, Body: []byte("up 1\n")},
+		},
+		{
+			name:  "exporter error",
+			reply: &exporterReply{Status: http.StatusServiceUnavailable, Header: http.Header{}, Body: []byte("busy")},
+			err:   errors.New("exporter returned\n503"),
+			want: &exporterReply{Status: http.StatusServiceUnavailable, Header: http.Header{
+				"Content-Type": {"text/plain"},
+			}, Body: []byte("busy")},
+			// Header values can not span lines
+			wantErr: "exporter returned 503",
+		},
+		{
+			name: "no reply",
+			err:  errors.New("dial tcp: connection refused"),
+			want: &exporterReply{Status: http.StatusBadGateway, Header: http.Header{
+				"Content-Type": {"text/plain"},
+			}},
+			wantErr: "dial tcp: connection refused",
+		},
+	}
+	for _, tt := range tests {
+		got, err := parseReplyMsg(newReplyMsg(tt.reply, tt.err))
+		if gotErr := fmt.Sprint(err); (err != nil || tt.wantErr != "") && gotErr != tt.wantErr {
+			t.Errorf("%s: got error %q, want %q", tt.name, gotErr, tt.wantErr)
+		}
+		if got.Status != tt.want.Status || string(got.Body) != string(tt.want.Body) {
+			t.Errorf("%s: got %d %q, want %d %q", tt.name, got.Status, got.Body, tt.want.Status, tt.want.Body)
+		}
+		for k := range tt.want.Header {
+			if got.Header.Get(k) != tt.want.Header.Get(k) {
+				t.Errorf("%s: header %v = %q, want %q", tt.name, k, got.Header.Get(k), tt.want.Header.Get(k))
+			}
+		}
+		if got.Header.Get("Set-Cookie") != "" {
+			t.Errorf("%s: exporter only header carried over", tt.name)
+		}
+	}
+}
+
+// Test replies from ambassadors without status headers and broken statuses
+func TestParseReplyMsgLegacy(t *testing.T) {
+	got, err := parseReplyMsg(&nats.Msg{Data: []byte("up 1\n")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Status != http.StatusOK || got.Header.Get("Content-Type") != "text/plain" || string(got.Body) != "up 1\n" {
+		t.Errorf("got %d %v %q", got.Status, got.Header, got.Body)
+	}
+
+	for _, status := range []string{"ok", "99", "1000"} {
+		msg := &nats.Msg{Header: nats.Header{}}
+		msg.Header.Set(hdrStatus, status)
+		if _, err := parseReplyMsg(msg); err == nil {
+			t.Errorf("expected error for status %q", status)
+		}
+	}
+}
+
+// Test the scrape `Accept` header reaches the exporter while hop-by-hop and
+// credential headers stop at the scraper side, and a negotiated binary reply
+// comes back as it is
+func TestForwardHeaders(t *testing.T) {
+	const protobufType = "application/vnd.google.protobuf; proto=io.prometheus.client.MetricFamily; encoding=delimited"
+	body := []byte{0x0a, 0x00, 0xff, 0x10, 0x0d, 0x0a}
+
+	var got http.Header
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.Header.Clone()
+		w.Header().Set("Content-Type", protobufType)
+		w.Write(body)
+	}))
+	defer srv.Close()
+
+	r := httptest.NewRequest(http.MethodGet, "/proxy?target=host1:9100", nil)
+	r.Header.Set("Accept", protobufType+";q=0.9,text/plain;q=0.1")
+	r.Header.Set("Authorization", "Bearer secret")
+	r.Header.Set("Proxy-Authorization", "Basic c2VjcmV0")
+	r.Header.Set("Cookie", "session=secret")
+	r.Header.Set("Connection", "keep-alive")
+	r.Header.Set("Te", "trailers")
+	r.Header.Set("X-Debug", "1")
+
+	hdr := forwardHeaders(r)
+	for _, k := range []string{"Authorization", "Proxy-Authorization", "Cookie", "Connection", "Te"} {
+		if _, ok := hdr[k]; ok {
+			t.Errorf("%v forwarded over NATS", k)
+		}
+	}
+	if hdr.Get("X-Debug") != "1" {
+		t.Errorf("route rule header not forwarded: %v", hdr)
+	}
+
+	reply, err := ProxyPrometheusRequest("test", srv.URL+"/metrics", "", http.Header(hdr), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Get("Accept") != r.Header.Get("Accept") {
+		t.Errorf("exporter got Accept %q", got.Get("Accept"))
+	}
+	for _, k := range []string{"Authorization", "Cookie", "X-Debug"} {
+		if got.Get(k) != "" {
+			t.Errorf("exporter got %v", k)
+		}
+	}
+
+	// Content type and binary body survive the NATS reply
+	back, err := parseReplyMsg(newReplyMsg(reply, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if back.Header.Get("Content-Type") != protobufType {
+		t.Errorf("got content type %q", back.Header.Get("Content-Type"))
+	}
+	if !bytes.Equal(back.Body, body) {
+		t.Errorf("got body %x, want %x", back.Body, body)
+	}
+}
+
+// Test replies are counted against the instance that served them
+func TestServedBy(t *testing.T) {
+	defer func(name string) { instanceName = name }(instanceName)
+	const subj = "io.prometheus.exporter.served_by.9100"
+	defer proxyServedBy.DeletePartialMatch(map[string]string{"subject": subj})
+
+	for _, name := range []string{"amb1", "amb2", "amb1"} {
+		instanceName = name
+		msg := newReplyMsg(&exporterReply{Status: http.StatusOK}, nil)
+		if got := msg.Header.Get(hdrInstance); got != name {
+			t.Errorf("reply from %q has instance %q", name, got)
+		}
+		countServedBy(subj, msg)
+	}
+	// Older exporter sides do not say who they are
+	countServedBy(subj, &nats.Msg{Data: []byte("up 1\n")})
+
+	for name, want := range map[string]float64{"amb1": 2, "amb2": 1, "": 0} {
+		if got := testutil.ToFloat64(proxyServedBy.WithLabelValues(subj, name)); got != want {
+			t.Errorf("instance %q served %v, want %v", name, got, want)
+		}
+	}
+}
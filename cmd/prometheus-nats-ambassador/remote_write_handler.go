@@ -13,6 +13,7 @@ package main
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
@@ -21,6 +22,7 @@ import (
 	"time"
 
 	"github.com/insikl/prometheus-nats-ambassador/internal/logger"
+	"github.com/nats-io/nats.go"
 	"github.com/prometheus/client_golang/prometheus"
 )
 
@@ -33,13 +35,14 @@ func (pubsub *ProxyConn) RemoteWriteHandler(w http.ResponseWriter, r *http.Reque
 
 	// Validate headers
 	// https://prometheus.io/docs/specs/prw/remote_write_spec/#protocol
-	// Prometheus Remote Write 1.0 spec
+	// https://prometheus.io/docs/specs/prw/remote_write_spec_2_0/#protocol
 	// The following headers MUST be sent with the HTTP request:
 	//
 	// Content-Encoding: snappy
-	// Content-Type: application/x-protobuf
+	// Content-Type: application/x-protobuf (1.0)
+	// Content-Type: application/x-protobuf;proto=io.prometheus.write.v2.Request (2.0)
 	// User-Agent: <name & version of the sender>
-	// X-Prometheus-Remote-Write-Version: 0.1.0
+	// X-Prometheus-Remote-Write-Version: 0.1.0 (1.0) or 2.0.0 (2.0)
 	enc := strings.ToLower(r.Header.Get("Content-Encoding"))
 	if enc != "snappy" && enc != "zstd" {
 		logger.Warn("Unexpected Content-Encoding: %s", r.Header.Get("Content-Encoding"))
@@ -47,14 +50,18 @@ func (pubsub *ProxyConn) RemoteWriteHandler(w http.ResponseWriter, r *http.Reque
 		return
 	}
 
-	if r.Header.Get("Content-Type") != "application/x-protobuf" {
-		logger.Warn("Unexpected Content-Type: %s", r.Header.Get("Content-Type"))
-		http.Error(w, "Content-Type must be application/x-protobuf", http.StatusBadRequest)
+	// 2.0 senders retry with 1.0 on a 415
+	contentType := r.Header.Get("Content-Type")
+	protoMsg, err := parseRemoteWriteProto(contentType)
+	if err != nil {
+		logger.Warn("Unexpected Content-Type: %s", contentType)
+		http.Error(w, err.Error(), http.StatusUnsupportedMediaType)
 		return
 	}
-	if r.Header.Get("X-Prometheus-Remote-Write-Version") != "0.1.0" {
-		logger.Warn("Unexpected X-Prometheus-Remote-Write-Version: %s", r.Header.Get("X-Prometheus-Remote-Write-Version"))
-		http.Error(w, "X-Prometheus-Remote-Write-Version must be 0.1.0", http.StatusBadRequest)
+	version := r.Header.Get(hdrRemoteWriteVersion)
+	if version != remoteWriteVersion1 && version != remoteWriteVersion2 {
+		logger.Warn("Unexpected X-Prometheus-Remote-Write-Version: %s", version)
+		http.Error(w, "X-Prometheus-Remote-Write-Version must be 0.1.0 or 2.0.0", http.StatusBadRequest)
 		return
 	}
 
@@ -72,6 +79,23 @@ func (pubsub *ProxyConn) RemoteWriteHandler(w http.ResponseWriter, r *http.Reque
 		return
 	}
 
+	// 2.0 senders take the written counts as what the receiver stored, only
+	// known once JetStream acked the message
+	var stats *remoteWriteStats
+	if protoMsg == remoteWriteProtoV2 {
+		raw, err := decodeRemoteWrite(compressedData, enc)
+		if err == nil {
+			var count remoteWriteStats
+			count, err = countRemoteWriteV2(raw)
+			stats = &count
+		}
+		if err != nil {
+			logger.Error("Error decoding remote write 2.0 request: %v", err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
 	if showDebug {
 		logger.Debug(
 			"Received Prometheus remote write request (size: %d bytes). Publishing to NATS topic '%s'...",
@@ -80,11 +104,28 @@ func (pubsub *ProxyConn) RemoteWriteHandler(w http.ResponseWriter, r *http.Reque
 		)
 	}
 
+	// Transcode for the WAN hop if set, example snappy from Prometheus to zstd
+	if remoteWriteEncoding != "" && remoteWriteEncoding != enc {
+		compressedData, err = transcodeRemoteWrite(compressedData, enc, remoteWriteEncoding)
+		if err != nil {
+			logger.Error("Error transcoding remote write: %v", err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		enc = remoteWriteEncoding
+	}
+
 	// Build subject
 	subj := topicBase + ".encoding." + enc
 
-	// Publish the raw compressed data to NATS
-	err = pubsub.nc.Publish(subj, compressedData)
+	// Publish the raw compressed data to NATS, the headers tell the relay
+	// which protocol version it is
+	msg := nats.NewMsg(subj)
+	msg.Header.Set("Content-Type", contentType)
+	msg.Header.Set("Content-Encoding", enc)
+	msg.Header.Set(hdrRemoteWriteVersion, version)
+	msg.Data = compressedData
+	stored, err := pubsub.publishRemoteWrite(msg)
 	if err != nil {
 		logger.Error("Error publishing to NATS: %v", err)
 		http.Error(w, "Failed to publish data to NATS", http.StatusInternalServerError)
@@ -92,7 +133,12 @@ func (pubsub *ProxyConn) RemoteWriteHandler(w http.ResponseWriter, r *http.Reque
 	}
 
 	// Acknowledge receipt to Prometheus
-	// 204 No Content is a common success response for remote write
+	// 204 No Content is a common success response for remote write. A plain
+	// NATS publish may still be lost, so the `*-Written` headers are left out
+	// rather than confirm samples nothing downstream has seen.
+	if stats != nil && stored {
+		stats.setHeaders(w.Header())
+	}
 	w.WriteHeader(http.StatusNoContent)
 	if showDebug {
 		logger.Debug("Successfully published data to NATS and acknowledged to Prometheus.")
@@ -101,29 +147,16 @@ func (pubsub *ProxyConn) RemoteWriteHandler(w http.ResponseWriter, r *http.Reque
 
 // relayPrometheusRemoteWrite forwards the raw compressed data to the remote write endpoint.
 // https://prometheus.io/docs/specs/prw/remote_write_spec/#protocol
-// Prometheus Remote Write 1.0 spec
-// The following headers MUST be sent with the HTTP request:
-//
-// Content-Encoding: snappy
-// Content-Type: application/x-protobuf
-// User-Agent: <name & version of the sender>
-// X-Prometheus-Remote-Write-Version: 0.1.0
+// https://prometheus.io/docs/specs/prw/remote_write_spec_2_0/#protocol
+// The protocol version and message type come from the NATS headers set by the
+// sender, messages without them are from older ambassadors and are 1.0.
 // func relayPrometheusRemoteWrite(compressedData []byte, w http.ResponseWriter, r *http.Request) error {
 func RelayPrometheusRemoteWrite(
 	topic string,
-	remoteWriteURL string,
+	target remoteWriteTarget,
+	hdr nats.Header,
 	compressedData []byte,
 ) (string, error) {
-	// Create a new HTTP POST request
-	req, err := http.NewRequest(
-		http.MethodPost,
-		remoteWriteURL,
-		bytes.NewBuffer(compressedData),
-	)
-	if err != nil {
-		return "", fmt.Errorf("failed to create HTTP request: %w", err)
-	}
-
 	// NOTE: decode topic to determine the content encoding of the message
 	// Example: io.prometheus.exporter.remote.<site>.encoding.snappy
 	// Example: io.prometheus.exporter.remote.<site>.encoding.zstd
@@ -154,7 +187,7 @@ func RelayPrometheusRemoteWrite(
 	case "snappy":
 		logger.Debug("Content encoding '%s' used by Prometheus.", encVal)
 	case "zstd":
-		logger.Debug("Content encoding '%s' used by VictoraMetrics.", encVal)
+		logger.Debug("Content encoding '%s' used by VictoriaMetrics.", encVal)
 	default:
 		// NOTE: This is for older versions of prometheus-nats-ambassador to
 		//       still work with each other below version 0.2.0.
@@ -162,18 +195,90 @@ func RelayPrometheusRemoteWrite(
 		encVal = "snappy"
 	}
 
-	// NOTE: will deprecate defaulting content-encoding and error out in future
-	if encVal != "snappy" {
-		return "", fmt.Errorf("Unknown content encoding type '%s'", encVal)
+	contentType := remoteWriteMediaType
+	protoMsg := remoteWriteProtoV1
+	version := remoteWriteVersion1
+	if ct := hdr.Get("Content-Type"); ct != "" {
+		var err error
+		protoMsg, err = parseRemoteWriteProto(ct)
+		if err != nil {
+			return "", err
+		}
+		contentType = ct
+	}
+	if v := hdr.Get(hdrRemoteWriteVersion); v != "" {
+		version = v
+	}
+
+	outEnc := target.Encoding
+	if outEnc == encodingPassthrough {
+		outEnc = encVal
+	}
+
+	var body []byte
+	var err error
+	if protoMsg == remoteWriteProtoV2 && target.Protocol == "v1" {
+		// Downgrade for a downstream that only speaks 1.0
+		var raw []byte
+		raw, err = decodeRemoteWrite(compressedData, encVal)
+		if err == nil {
+			raw, err = downgradeRemoteWriteV2(raw)
+		}
+		if err == nil {
+			body, err = encodeRemoteWrite(raw, outEnc)
+		}
+		if err != nil {
+			return "", fmt.Errorf("failed to downgrade remote write 2.0: %w", err)
+		}
+		contentType = remoteWriteMediaType
+		version = remoteWriteVersion1
+	} else {
+		// Transcode for the downstream if it wants a different encoding
+		body, err = transcodeRemoteWrite(compressedData, encVal, target.Encoding)
+		if err != nil {
+			return "", err
+		}
 	}
+	encVal = outEnc
 
 	// Set the required Prometheus remote write headers from the input collected
-	// Prometheus Remote Write 1.0 spec
-	// https://prometheus.io/docs/specs/prw/remote_write_spec/#protocol
-	req.Header.Set("Content-Type", "application/x-protobuf")
-	req.Header.Set("Content-Encoding", encVal)
-	req.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
-	req.Header.Set("User-Agent", userAgent)
+	header := http.Header{}
+	header.Set("Content-Type", contentType)
+	header.Set("Content-Encoding", encVal)
+	header.Set(hdrRemoteWriteVersion, version)
+	header.Set("User-Agent", userAgent)
+
+	err = retryRemoteWrite(target.URL, func() error {
+		return postRemoteWrite(topic, target.URL, header, body)
+	})
+	if err != nil {
+		return "", err
+	}
+
+	if showDebug {
+		logger.Debug(
+			"Successfully relayed %d bytes as %s to %s",
+			len(body),
+			encVal,
+			target.URL,
+		)
+	}
+
+	return "", nil
+}
+
+// Send one remote write request
+func postRemoteWrite(topic, endpoint string, header http.Header, body []byte) error {
+	// Create a new HTTP POST request
+	req, err := http.NewRequest(
+		http.MethodPost,
+		endpoint,
+		bytes.NewReader(body),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to create HTTP request: %w", err)
+	}
+	req.Header = header.Clone()
 
 	// Send the request
 	client := http.Client{
@@ -181,7 +286,7 @@ func RelayPrometheusRemoteWrite(
 	}
 	resp, err := client.Do(req)
 	if err != nil {
-		return "", fmt.Errorf("failed to send HTTP request: %w", err)
+		return fmt.Errorf("failed to send HTTP request: %w", err)
 	}
 	defer resp.Body.Close() // Ensure the response body is closed
 
@@ -198,18 +303,49 @@ func RelayPrometheusRemoteWrite(
 	}
 
 	// Check the response status code
-	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNoContent {
-		return "", fmt.Errorf("remote write endpoint returned non-success status: %s (body: %s)", resp.Status, string(responseBody))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		statusErr := &remoteWriteStatusError{
+			StatusCode: resp.StatusCode,
+			Status:     resp.Status,
+			Body:       string(responseBody),
+		}
+		if resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode == http.StatusServiceUnavailable {
+			statusErr.RetryAfter = parseRetryAfter(resp.Header.Get("Retry-After"), time.Now())
+		}
+		return statusErr
 	}
+	return nil
+}
 
-	if showDebug {
-		logger.Debug(
-			"Successfully relayed %d bytes to %s, status: %s",
-			len(compressedData),
-			remoteWriteURL,
-			resp.Status,
-		)
-	}
+// Non-2xx reply from a remote write endpoint
+type remoteWriteStatusError struct {
+	StatusCode int
+	Status     string
+	Body       string
+	// From `Retry-After` on a 429 or 503
+	RetryAfter time.Duration
+}
 
-	return "", nil
+func (e *remoteWriteStatusError) Error() string {
+	return fmt.Sprintf("remote write endpoint returned non-success status: %s (body: %s)", e.Status, e.Body)
+}
+
+// Whether a failed relay is worth sending again. The spec says a 4xx other
+// than 429 must not be retried, anything else (5xx, connection errors) may.
+// Joined errors from several downstreams are retryable if any of them is.
+// https://prometheus.io/docs/specs/prw/remote_write_spec/#retries-backoff
+func remoteWriteRetryable(err error) bool {
+	if joined, ok := err.(interface{ Unwrap() []error }); ok {
+		for _, e := range joined.Unwrap() {
+			if remoteWriteRetryable(e) {
+				return true
+			}
+		}
+		return false
+	}
+	var statusErr *remoteWriteStatusError
+	if errors.As(err, &statusErr) {
+		return statusErr.StatusCode == http.StatusTooManyRequests || statusErr.StatusCode >= 500
+	}
+	return true
 }
@@ -0,0 +1,254 @@
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/nats-io/nats.go"
+
+	"github.com/insikl/prometheus-nats-ambassador/internal/logger"
+)
+
+// With core NATS a write is gone once Prometheus got its 204, even if the
+// relay or the TSDB behind it is down. With `-jsstream` the sender only answers
+// 204 after the stream acked the publish, and the relay reads through a durable
+// consumer, acking once every downstream returned 2xx. The stream has to exist
+// and capture the `-subjbase` of the senders.
+// https://docs.nats.io/nats-concepts/jetstream
+var (
+	jsStream     = ""
+	jsDurable    = "prometheus-nats-ambassador"
+	jsMaxDeliver = 10
+	jsAckWait    = 30 * time.Second
+	jsBackoff    = []time.Duration{
+		time.Second,
+		5 * time.Second,
+		30 * time.Second,
+		time.Minute,
+		5 * time.Minute,
+	}
+)
+
+// Parse a comma separated list of durations such as `-jsbackoff`
+func parseDurations(value string) ([]time.Duration, error) {
+	var durations []time.Duration
+	for _, field := range strings.Split(value, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		d, err := time.ParseDuration(field)
+		if err != nil {
+			return nil, err
+		}
+		if d <= 0 {
+			return nil, fmt.Errorf("duration %v must be positive", d)
+		}
+		durations = append(durations, d)
+	}
+	return durations, nil
+}
+
+// Delay before the next delivery after `delivered` attempts, the last backoff
+// value is kept for every attempt after that
+func redeliveryDelay(delivered uint64) time.Duration {
+	if len(jsBackoff) == 0 || delivered == 0 {
+		return 0
+	}
+	if delivered > uint64(len(jsBackoff)) {
+		return jsBackoff[len(jsBackoff)-1]
+	}
+	return jsBackoff[delivered-1]
+}
+
+// Publish a remote write message, through JetStream with a publish ack when
+// enabled. `stored` is only true once the stream acked the message.
+func (pubsub *ProxyConn) publishRemoteWrite(msg *nats.Msg) (stored bool, err error) {
+	if pubsub.js == nil {
+		return false, pubsub.nc.PublishMsg(msg)
+	}
+	ack, err := pubsub.js.PublishMsg(msg, nats.ExpectStream(jsStream))
+	if err != nil {
+		return false, err
+	}
+	if showDebug {
+		logger.Debug("Stored remote write in stream [%v] seq [%v]", ack.Stream, ack.Sequence)
+	}
+	return true, nil
+}
+
+// Post a remote write message to every downstream not marked in done, marking
+// the ones that took it. The errors of all downstreams
+// are joined, see `remoteWriteRetryable`.
+func relayRemoteWrite(msg *nats.Msg, targets []remoteWriteTarget, done []bool) error {
+	var errs []error
+	for i, target := range targets {
+		if done[i] {
+			continue
+		}
+		if showDebug {
+			logger.Debug(
+				"incoming message for relay on [%v] to endpoint [%v]",
+				msg.Subject,
+				target.URL,
+			)
+		}
+
+		_, err := RelayPrometheusRemoteWrite(
+			msg.Subject,
+			target,
+			msg.Header,
+			msg.Data,
+		)
+		if err != nil {
+			logger.Error("Error on response from [%v]: [%v]", target.URL, err)
+			errs = append(errs, err)
+		} else {
+			done[i] = true
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Settling of a JetStream message, the `*nats.Msg` itself outside of tests
+type jsMessage interface {
+	Metadata() (*nats.MsgMetadata, error)
+	Ack(opts ...nats.AckOpt) error
+	Nak(opts ...nats.AckOpt) error
+	NakWithDelay(delay time.Duration, opts ...nats.AckOpt) error
+	Term(opts ...nats.AckOpt) error
+	InProgress(opts ...nats.AckOpt) error
+}
+
+// Relay from the durable consumer. Acked when every downstream took it,
+// terminated when the ones left rejected it for good (4xx) or after
+// `-jsmaxdeliver` deliveries, and otherwise sent again after the backoff.
+// A redelivery only goes to the downstreams that did not take it yet, as long
+// as this relay is the one that saw the earlier deliveries.
+type jsRelay struct {
+	targets []remoteWriteTarget
+	// Downstreams that took a message, by stream sequence
+	done map[uint64]*jsRelayDone
+}
+
+// Downstreams that took a nak'd message. Forgotten once the redelivery is
+// overdue, it went to another relay in the group or left the stream.
+type jsRelayDone struct {
+	targets []bool
+	expires time.Time
+}
+
+func newJSRelay(targets []remoteWriteTarget) *jsRelay {
+	return &jsRelay{targets: targets, done: make(map[uint64]*jsRelayDone)}
+}
+
+// Forget messages whose redelivery did not come back to this relay
+func (r *jsRelay) expire(now time.Time) {
+	for seq, d := range r.done {
+		if now.After(d.expires) {
+			delete(r.done, seq)
+		}
+	}
+}
+
+// Relay and settle a message, returns the result counted in the metrics.
+// Called from the subscription callback only, so one message at a time.
+func (r *jsRelay) handle(msg *nats.Msg, ack jsMessage) string {
+	var delivered, seq uint64
+	if meta, err := ack.Metadata(); err == nil {
+		delivered, seq = meta.NumDelivered, meta.Sequence.Stream
+	}
+	r.expire(time.Now())
+	var done []bool
+	if d := r.done[seq]; d != nil {
+		done = d.targets
+	} else {
+		done = make([]bool, len(r.targets))
+	}
+
+	// Keep the message from being redelivered while the downstreams
+	// take longer than the ack wait
+	stop := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(jsAckWait / 2)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				ack.InProgress()
+			}
+		}
+	}()
+	err := relayRemoteWrite(msg, r.targets, done)
+	close(stop)
+
+	var result string
+	var ackErr error
+	switch {
+	case err == nil:
+		result = "ack"
+		ackErr = ack.Ack()
+	case !remoteWriteRetryable(err):
+		result = "term"
+		ackErr = ack.Term()
+		logger.Warn("Dropping remote write on [%v], rejected by downstream: %v", msg.Subject, err)
+	case jsMaxDeliver > 0 && delivered >= uint64(jsMaxDeliver):
+		result = "term"
+		ackErr = ack.Term()
+		logger.Warn("Giving up on remote write on [%v] after %d deliveries: %v", msg.Subject, delivered, err)
+	default:
+		result = "nak"
+		if delay := redeliveryDelay(delivered); delay > 0 {
+			ackErr = ack.NakWithDelay(delay)
+		} else {
+			ackErr = ack.Nak()
+		}
+	}
+
+	if result == "nak" && seq != 0 {
+		r.done[seq] = &jsRelayDone{
+			targets: done,
+			expires: time.Now().Add(redeliveryDelay(delivered) + jsAckWait),
+		}
+	} else {
+		delete(r.done, seq)
+	}
+	remoteWriteAcks.WithLabelValues(result).Inc()
+	if ackErr != nil {
+		logger.Error("Error on %v of remote write on [%v]: %v", result, msg.Subject, ackErr)
+	}
+	return result
+}
+
+// Subscribe the relay through a durable consumer on `-jsstream`. Relays using
+// the same durable share the messages between them.
+func (pubsub *ProxyConn) subscribeRemoteWriteJetStream(targets []remoteWriteTarget) (*nats.Subscription, error) {
+	relay := newJSRelay(targets)
+	return pubsub.js.QueueSubscribe(
+		topicBase,
+		jsDurable,
+		func(msg *nats.Msg) { relay.handle(msg, msg) },
+		nats.BindStream(jsStream),
+		nats.Durable(jsDurable),
+		nats.ManualAck(),
+		nats.AckExplicit(),
+		nats.AckWait(jsAckWait),
+		nats.MaxDeliver(jsMaxDeliver),
+		nats.DeliverAll(),
+	)
+}
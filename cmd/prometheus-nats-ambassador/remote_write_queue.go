@@ -0,0 +1,63 @@
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"github.com/nats-io/nats.go"
+
+	"github.com/insikl/prometheus-nats-ambassador/internal/logger"
+)
+
+// Retries and backoff of one downstream must not hold up the NATS
+// subscription callback, or the pending limits fill up and the client is
+// dropped as a slow consumer. On core NATS each downstream gets a queue of
+// up to `-rwqueue` messages and its own worker. A full queue drops the
+// message.
+var remoteWriteQueueSize = 1000
+
+// Bounded queue of messages for one downstream
+type remoteWriteQueue struct {
+	target remoteWriteTarget
+	msgs   chan *nats.Msg
+	// Send one message, or add it to the spool with `-spooldir`
+	deliver func(msg *nats.Msg) error
+}
+
+func newRemoteWriteQueue(target remoteWriteTarget, deliver func(msg *nats.Msg) error) *remoteWriteQueue {
+	return &remoteWriteQueue{
+		target:  target,
+		msgs:    make(chan *nats.Msg, remoteWriteQueueSize),
+		deliver: deliver,
+	}
+}
+
+// Queue a message without blocking
+func (q *remoteWriteQueue) push(msg *nats.Msg) {
+	select {
+	case q.msgs <- msg:
+		remoteWriteQueueDepth.WithLabelValues(q.target.URL).Inc()
+		return
+	default:
+	}
+	remoteWriteQueueDropped.WithLabelValues(q.target.URL).Inc()
+	logger.Warn("Dropping remote write on [%v], queue for [%v] is full", msg.Subject, q.target.URL)
+}
+
+// Deliver queued messages in order until the queue is closed
+func (q *remoteWriteQueue) run() {
+	for msg := range q.msgs {
+		remoteWriteQueueDepth.WithLabelValues(q.target.URL).Dec()
+		if err := q.deliver(msg); err != nil {
+			logger.Error("Error on response from [%v]: [%v]", q.target.URL, err)
+		}
+	}
+}
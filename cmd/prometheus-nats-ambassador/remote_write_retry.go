@@ -0,0 +1,107 @@
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/insikl/prometheus-nats-ambassador/internal/logger"
+)
+
+// A downstream answering 429/5xx or not answering at all gets the batch again
+// with exponential backoff and jitter, same as Prometheus does with its own
+// remote write queues. `Retry-After` wins over the backoff. Each message gets
+// at most `-rwretries` retries within `-rwretrybudget`, after that the error
+// goes back to the caller (logged, or nak'ed with JetStream).
+// https://prometheus.io/docs/specs/prw/remote_write_spec/#retries-backoff
+var (
+	remoteWriteMaxRetries  = 5
+	remoteWriteRetryBudget = time.Minute
+	remoteWriteMinBackoff  = 30 * time.Millisecond
+	remoteWriteMaxBackoff  = 5 * time.Second
+)
+
+// Parse `Retry-After` as seconds or a HTTP date, 0 when missing or invalid
+func parseRetryAfter(value string, now time.Time) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if secs, err := strconv.Atoi(value); err == nil {
+		if secs < 0 {
+			return 0
+		}
+		return time.Duration(secs) * time.Second
+	}
+	if t, err := http.ParseTime(value); err == nil && t.After(now) {
+		return t.Sub(now)
+	}
+	return 0
+}
+
+// Delay before the retry after `attempt` failed attempts, doubling from the
+// min backoff up to the max with the upper half jittered
+func remoteWriteBackoff(attempt int, err error) time.Duration {
+	var statusErr *remoteWriteStatusError
+	if errors.As(err, &statusErr) && statusErr.RetryAfter > 0 {
+		return statusErr.RetryAfter
+	}
+
+	delay := remoteWriteMinBackoff
+	for i := 1; i < attempt && delay < remoteWriteMaxBackoff; i++ {
+		delay *= 2
+	}
+	delay = min(delay, remoteWriteMaxBackoff)
+	if delay <= 1 {
+		return delay
+	}
+	return delay/2 + rand.N(delay/2)
+}
+
+// Call send until it succeeds, fails for good or the retry budget is spent
+func retryRemoteWrite(endpoint string, send func() error) error {
+	start := time.Now()
+	var retrying time.Time
+	defer func() {
+		if !retrying.IsZero() {
+			remoteWriteRetrySeconds.WithLabelValues(endpoint).Add(time.Since(retrying).Seconds())
+		}
+	}()
+
+	for attempt := 1; ; attempt++ {
+		err := send()
+		if err == nil || !remoteWriteRetryable(err) {
+			return err
+		}
+
+		delay := remoteWriteBackoff(attempt, err)
+		if attempt > remoteWriteMaxRetries || time.Since(start)+delay > remoteWriteRetryBudget {
+			// Only once retries were tried, `-rwretries 0` has nothing to give up
+			if attempt > 1 {
+				remoteWriteGiveUps.WithLabelValues(endpoint).Inc()
+				return fmt.Errorf("giving up after %d attempts: %w", attempt, err)
+			}
+			return err
+		}
+
+		if retrying.IsZero() {
+			retrying = time.Now()
+		}
+		logger.Warn("Remote write to [%v] failed, retry %d in %v: %v", endpoint, attempt, delay, err)
+		remoteWriteRetriesTotal.WithLabelValues(endpoint).Inc()
+		time.Sleep(delay)
+	}
+}
@@ -0,0 +1,169 @@
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"path/filepath"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/insikl/prometheus-nats-ambassador/internal/logger"
+	"github.com/insikl/prometheus-nats-ambassador/internal/spool"
+)
+
+// Without JetStream an outage of the downstream longer than the retry budget
+// loses writes. With `-spooldir` every message for a downstream goes through
+// a size capped on-disk queue: the queue worker appends it and the replay is
+// the only sender, so messages reach the downstream in order however long it
+// is down.
+var (
+	spoolDir                 = ""
+	spoolMaxBytes      int64 = 1 << 30
+	spoolSegmentBytes  int64 = 64 << 20
+	spoolRetryInterval       = 10 * time.Second
+)
+
+// Downstream with its spool
+type spooledTarget struct {
+	target remoteWriteTarget
+	spool  *spool.Spool
+	// Wakes up the replay when a record is added to an empty spool
+	wake chan struct{}
+}
+
+// Directory of the spool for a downstream, the same URL can be listed with
+// different options
+func spoolPath(target remoteWriteTarget) string {
+	h := fnv.New64a()
+	h.Write([]byte(target.String()))
+	return filepath.Join(spoolDir, fmt.Sprintf("%016x", h.Sum64()))
+}
+
+// Open the spool of a downstream and register its metrics
+func newSpooledTarget(target remoteWriteTarget) (*spooledTarget, error) {
+	dir := spoolPath(target)
+	sp, err := spool.Open(dir, spoolMaxBytes, spoolSegmentBytes)
+	if err != nil {
+		return nil, fmt.Errorf("spool for %v: %w", target.URL, err)
+	}
+	logger.Info("Spooling remote write for [%v] in [%v], %d bytes pending", target, dir, sp.Bytes())
+
+	labels := prometheus.Labels{
+		"url":      target.URL,
+		"encoding": target.Encoding,
+		"protocol": target.Protocol,
+	}
+	prometheus.MustRegister(prometheus.NewGaugeFunc(
+		prometheus.GaugeOpts{
+			Namespace:   "natsambassador",
+			Name:        "remote_write_spool_bytes",
+			Help:        "Bytes of remote write waiting in the on-disk spool",
+			ConstLabels: labels,
+		},
+		func() float64 { return float64(sp.Bytes()) },
+	))
+	prometheus.MustRegister(prometheus.NewGaugeFunc(
+		prometheus.GaugeOpts{
+			Namespace:   "natsambassador",
+			Name:        "remote_write_spool_oldest_age_seconds",
+			Help:        "Age of the oldest remote write in the on-disk spool, 0 when empty",
+			ConstLabels: labels,
+		},
+		func() float64 {
+			oldest := sp.Oldest()
+			if oldest.IsZero() {
+				return 0
+			}
+			return time.Since(oldest).Seconds()
+		},
+	))
+	prometheus.MustRegister(prometheus.NewCounterFunc(
+		prometheus.CounterOpts{
+			Namespace:   "natsambassador",
+			Name:        "remote_write_spool_dropped_bytes_total",
+			Help:        "Bytes of remote write dropped from the on-disk spool over the size cap",
+			ConstLabels: labels,
+		},
+		func() float64 { return float64(sp.Dropped()) },
+	))
+
+	return &spooledTarget{target: target, spool: sp, wake: make(chan struct{}, 1)}, nil
+}
+
+// Add a message to the end of the spool
+func (st *spooledTarget) add(msg *nats.Msg) error {
+	err := st.spool.Append(spool.Record{
+		Time:    time.Now(),
+		Subject: msg.Subject,
+		Header:  msg.Header,
+		Data:    msg.Data,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to spool: %w", err)
+	}
+	select {
+	case st.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// Send the spooled messages in order, waiting `spoolRetryInterval` between
+// tries while the downstream is down. Runs until stop is closed, nil to run
+// forever.
+func (st *spooledTarget) replay(stop <-chan struct{}) {
+	wait := func(wake <-chan struct{}) bool {
+		select {
+		case <-stop:
+			return false
+		case <-wake:
+		case <-time.After(spoolRetryInterval):
+		}
+		return true
+	}
+
+	for {
+		rec, err := st.spool.Peek()
+		if errors.Is(err, spool.ErrEmpty) {
+			if !wait(st.wake) {
+				return
+			}
+			continue
+		}
+		if err != nil {
+			logger.Error("Error reading spool for [%v]: %v", st.target.URL, err)
+			if !wait(nil) {
+				return
+			}
+			continue
+		}
+
+		_, err = RelayPrometheusRemoteWrite(rec.Subject, st.target, nats.Header(rec.Header), rec.Data)
+		if err != nil && remoteWriteRetryable(err) {
+			if !wait(nil) {
+				return
+			}
+			continue
+		}
+		if err != nil {
+			logger.Warn("Dropping spooled remote write for [%v], rejected by downstream: %v", st.target.URL, err)
+		}
+		if err := st.spool.Commit(); err != nil {
+			logger.Error("Error committing spool for [%v]: %v", st.target.URL, err)
+		}
+	}
+}
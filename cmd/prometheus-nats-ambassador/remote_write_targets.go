@@ -0,0 +1,164 @@
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/klauspost/compress/s2"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Remote write bodies are snappy (Prometheus) or zstd (VictoriaMetrics/vmagent)
+// compressed. Either is relayed as is, or transcoded on the way, zstd is
+// usually a lot smaller on the WAN hop.
+// https://prometheus.io/docs/specs/prw/remote_write_spec/#protocol
+const (
+	encodingSnappy      = "snappy"
+	encodingZstd        = "zstd"
+	encodingPassthrough = "passthrough"
+)
+
+// Encoding the sender side publishes remote write on, empty to keep what the
+// sender used. Set with `-rwencoding`.
+var remoteWriteEncoding = ""
+
+// Downstream remote write endpoint on the relay side. `-remotewrite` takes a
+// comma separated list of `URL|key=value|...`, example:
+//
+//	http://prometheus:9090/api/v1/write|encoding=snappy,http://vm:8428/api/v1/write
+type remoteWriteTarget struct {
+	URL string
+	// Encoding the downstream gets, `passthrough` for whatever came in
+	Encoding string
+	// Protocol the downstream gets, `v1` to downgrade 2.0 requests or
+	// `passthrough` for whatever came in
+	Protocol string
+}
+
+// Endpoint with its options, unique per `-remotewrite` entry
+func (target remoteWriteTarget) String() string {
+	return target.URL + "|encoding=" + target.Encoding + "|protocol=" + target.Protocol
+}
+
+// Parse `-remotewrite`
+func parseRemoteWriteTargets(value string) ([]remoteWriteTarget, error) {
+	var targets []remoteWriteTarget
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		fields := strings.Split(entry, "|")
+		target := remoteWriteTarget{
+			URL:      fields[0],
+			Encoding: encodingPassthrough,
+			Protocol: encodingPassthrough,
+		}
+		for _, opt := range fields[1:] {
+			key, val, ok := strings.Cut(opt, "=")
+			if !ok {
+				return nil, fmt.Errorf("remote write %v: expected key=value, got %q", target.URL, opt)
+			}
+			switch key {
+			case "encoding":
+				if err := checkRemoteWriteEncoding(val, true); err != nil {
+					return nil, fmt.Errorf("remote write %v: %w", target.URL, err)
+				}
+				target.Encoding = val
+			case "protocol":
+				if val != "v1" && val != encodingPassthrough {
+					return nil, fmt.Errorf("remote write %v: unsupported protocol %q", target.URL, val)
+				}
+				target.Protocol = val
+			default:
+				return nil, fmt.Errorf("remote write %v: unknown option %q", target.URL, key)
+			}
+		}
+		for _, seen := range targets {
+			if seen == target {
+				return nil, fmt.Errorf("remote write %v: duplicate endpoint", target.URL)
+			}
+		}
+		targets = append(targets, target)
+	}
+	if len(targets) == 0 {
+		return nil, fmt.Errorf("no remote write endpoints in %q", value)
+	}
+	return targets, nil
+}
+
+func checkRemoteWriteEncoding(enc string, passthrough bool) error {
+	switch enc {
+	case encodingSnappy, encodingZstd:
+		return nil
+	case encodingPassthrough:
+		if passthrough {
+			return nil
+		}
+	}
+	return fmt.Errorf("unsupported remote write encoding %q", enc)
+}
+
+// Convert a remote write body between encodings. Remote write uses the snappy
+// block format, not the framed one.
+func transcodeRemoteWrite(data []byte, from, to string) ([]byte, error) {
+	if to == encodingPassthrough || from == to {
+		return data, nil
+	}
+
+	raw, err := decodeRemoteWrite(data, from)
+	if err != nil {
+		return nil, err
+	}
+	out, err := encodeRemoteWrite(raw, to)
+	if err != nil {
+		return nil, err
+	}
+
+	labels := prometheus.Labels{"from": from, "to": to}
+	labels["stage"] = "before"
+	remoteWriteTranscodeBytes.With(labels).Add(float64(len(data)))
+	labels["stage"] = "after"
+	remoteWriteTranscodeBytes.With(labels).Add(float64(len(out)))
+	return out, nil
+}
+
+// Decompress a remote write body
+func decodeRemoteWrite(data []byte, enc string) ([]byte, error) {
+	var raw []byte
+	var err error
+	switch enc {
+	case encodingSnappy:
+		raw, err = s2.Decode(nil, data)
+	case encodingZstd:
+		raw, err = zstdDecoder.DecodeAll(data, nil)
+	default:
+		err = fmt.Errorf("unsupported remote write encoding %q", enc)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode %v: %w", enc, err)
+	}
+	return raw, nil
+}
+
+// Compress a remote write body
+func encodeRemoteWrite(raw []byte, enc string) ([]byte, error) {
+	switch enc {
+	case encodingSnappy:
+		return s2.EncodeSnappy(nil, raw), nil
+	case encodingZstd:
+		return zstdEncoder.EncodeAll(raw, nil), nil
+	}
+	return nil, fmt.Errorf("unsupported remote write encoding %q", enc)
+}
@@ -0,0 +1,583 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/klauspost/compress/s2"
+	"github.com/nats-io/nats.go"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// Test remote write is relayed natively or transcoded per downstream
+func TestRelayRemoteWrite(t *testing.T) {
+	raw := bytes.Repeat([]byte("remote write protobuf "), 64)
+	snappyBody := s2.EncodeSnappy(nil, raw)
+
+	var gotEncoding string
+	var gotBody []byte
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotEncoding = r.Header.Get("Content-Encoding")
+		gotBody, _ = io.ReadAll(r.Body)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+
+	targets, err := parseRemoteWriteTargets(srv.URL + "|encoding=zstd," + srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(targets) != 2 || targets[1].Encoding != encodingPassthrough {
+		t.Fatalf("unexpected targets %+v", targets)
+	}
+
+	// snappy from Prometheus transcoded to zstd for the downstream
+	if _, err := RelayPrometheusRemoteWrite("rw.site1.encoding.snappy", targets[0], nil, snappyBody); err != nil {
+		t.Fatal(err)
+	}
+	if gotEncoding != "zstd" {
+		t.Errorf("got encoding %q", gotEncoding)
+	}
+	zstdBody := gotBody
+	if decoded, err := zstdDecoder.DecodeAll(zstdBody, nil); err != nil || !bytes.Equal(decoded, raw) {
+		t.Errorf("zstd body does not decode: %v", err)
+	}
+
+	// zstd relayed as is
+	if _, err := RelayPrometheusRemoteWrite("rw.site1.encoding.zstd", targets[1], nil, zstdBody); err != nil {
+		t.Fatal(err)
+	}
+	if gotEncoding != "zstd" || !bytes.Equal(gotBody, zstdBody) {
+		t.Errorf("expected zstd passthrough, got %q", gotEncoding)
+	}
+
+	for _, value := range []string{"", "http://x|encoding=lz4", "http://x|retries", "http://x|protocol=v3", "http://x,http://x|encoding=passthrough"} {
+		if _, err := parseRemoteWriteTargets(value); err == nil {
+			t.Errorf("expected error for %q", value)
+		}
+	}
+}
+
+// Build a 2.0 request with one series carrying a sample, an exemplar and
+// counter metadata
+func testRemoteWriteV2() []byte {
+	var out []byte
+	for _, s := range []string{"", "__name__", "http_requests_total", "job", "api", "trace_id", "abc", "Requests", "requests"} {
+		out = protowire.AppendTag(out, v2RequestSymbols, protowire.BytesType)
+		out = protowire.AppendString(out, s)
+	}
+
+	var sample, exemplar, meta, series []byte
+	sample = protowire.AppendTag(sample, 1, protowire.Fixed64Type)
+	sample = protowire.AppendFixed64(sample, math.Float64bits(42))
+	sample = protowire.AppendTag(sample, 2, protowire.VarintType)
+	sample = protowire.AppendVarint(sample, 1000)
+
+	exemplar = protowire.AppendTag(exemplar, v2ExemplarLabelsRefs, protowire.BytesType)
+	exemplar = protowire.AppendBytes(exemplar, []byte{5, 6})
+	exemplar = protowire.AppendTag(exemplar, 2, protowire.Fixed64Type)
+	exemplar = protowire.AppendFixed64(exemplar, math.Float64bits(1))
+
+	meta = protowire.AppendTag(meta, v2MetadataType, protowire.VarintType)
+	meta = protowire.AppendVarint(meta, 1)
+	meta = protowire.AppendTag(meta, v2MetadataHelpRef, protowire.VarintType)
+	meta = protowire.AppendVarint(meta, 7)
+	meta = protowire.AppendTag(meta, v2MetadataUnitRef, protowire.VarintType)
+	meta = protowire.AppendVarint(meta, 8)
+
+	series = protowire.AppendTag(series, v2SeriesLabelsRefs, protowire.BytesType)
+	series = protowire.AppendBytes(series, []byte{1, 2, 3, 4})
+	series = protowire.AppendTag(series, v2SeriesSamples, protowire.BytesType)
+	series = protowire.AppendBytes(series, sample)
+	series = protowire.AppendTag(series, v2SeriesExemplars, protowire.BytesType)
+	series = protowire.AppendBytes(series, exemplar)
+	series = protowire.AppendTag(series, v2SeriesMetadata, protowire.BytesType)
+	series = protowire.AppendBytes(series, meta)
+
+	out = protowire.AppendTag(out, v2RequestTimeseries, protowire.BytesType)
+	return protowire.AppendBytes(out, series)
+}
+
+// Test 2.0 requests are counted and relayed as is or downgraded to 1.0
+func TestRelayRemoteWriteV2(t *testing.T) {
+	raw := testRemoteWriteV2()
+
+	stats, err := countRemoteWriteV2(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats != (remoteWriteStats{samples: 1, exemplars: 1}) {
+		t.Errorf("unexpected counts %+v", stats)
+	}
+
+	for ct, want := range map[string]string{
+		"application/x-protobuf":                                      remoteWriteProtoV1,
+		"application/x-protobuf;proto=prometheus.WriteRequest":        remoteWriteProtoV1,
+		"application/x-protobuf;proto=io.prometheus.write.v2.Request": remoteWriteProtoV2,
+		"application/x-protobuf;proto=other":                          "",
+		"application/json":                                            "",
+	} {
+		got, err := parseRemoteWriteProto(ct)
+		if got != want || (want == "") != (err != nil) {
+			t.Errorf("%q: got %q, %v", ct, got, err)
+		}
+	}
+
+	var gotHeader http.Header
+	var gotBody []byte
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotHeader = r.Header
+		gotBody, _ = io.ReadAll(r.Body)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+
+	targets, err := parseRemoteWriteTargets(srv.URL + "," + srv.URL + "|protocol=v1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	hdr := nats.Header{}
+	hdr.Set("Content-Type", "application/x-protobuf;proto="+remoteWriteProtoV2)
+	hdr.Set(hdrRemoteWriteVersion, remoteWriteVersion2)
+	body := s2.EncodeSnappy(nil, raw)
+
+	// Version and message type preserved
+	if _, err := RelayPrometheusRemoteWrite("rw.site1.encoding.snappy", targets[0], hdr, body); err != nil {
+		t.Fatal(err)
+	}
+	if gotHeader.Get(hdrRemoteWriteVersion) != remoteWriteVersion2 || !bytes.Equal(gotBody, body) {
+		t.Errorf("expected 2.0 passthrough, got %v", gotHeader)
+	}
+
+	// Downgraded to 1.0
+	if _, err := RelayPrometheusRemoteWrite("rw.site1.encoding.snappy", targets[1], hdr, body); err != nil {
+		t.Fatal(err)
+	}
+	if gotHeader.Get(hdrRemoteWriteVersion) != remoteWriteVersion1 || gotHeader.Get("Content-Type") != remoteWriteMediaType {
+		t.Errorf("expected 1.0 headers, got %v", gotHeader)
+	}
+	v1, err := s2.Decode(nil, gotBody)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var series, metadata int
+	var labels []string
+	err = eachField(v1, func(num protowire.Number, _ protowire.Type, val []byte) error {
+		switch num {
+		case v1RequestTimeseries:
+			series++
+			return eachField(val, func(num protowire.Number, _ protowire.Type, val []byte) error {
+				if num == v1SeriesLabels {
+					return eachField(val, func(_ protowire.Number, _ protowire.Type, val []byte) error {
+						labels = append(labels, string(val))
+						return nil
+					})
+				}
+				return nil
+			})
+		case v1RequestMetadata:
+			metadata++
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"__name__", "http_requests_total", "job", "api"}
+	if series != 1 || metadata != 1 || strings.Join(labels, ",") != strings.Join(want, ",") {
+		t.Errorf("unexpected downgrade: %d series, %d metadata, labels %v", series, metadata, labels)
+	}
+}
+
+// Test redelivery delays and which downstream replies are retryable
+func TestRemoteWriteBackoffStatus(t *testing.T) {
+	backoff, err := parseDurations("1s, 5s,30s")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func(saved []time.Duration) { jsBackoff = saved }(jsBackoff)
+	jsBackoff = backoff
+	for delivered, want := range map[uint64]time.Duration{0: 0, 1: time.Second, 2: 5 * time.Second, 3: 30 * time.Second, 9: 30 * time.Second} {
+		if got := redeliveryDelay(delivered); got != want {
+			t.Errorf("delivery %d: got %v, want %v", delivered, got, want)
+		}
+	}
+	for _, value := range []string{"1s,soon", "0s"} {
+		if _, err := parseDurations(value); err == nil {
+			t.Errorf("expected error for %q", value)
+		}
+	}
+
+	var status int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+	}))
+	defer srv.Close()
+
+	defer func(saved int) { remoteWriteMaxRetries = saved }(remoteWriteMaxRetries)
+	remoteWriteMaxRetries = 0
+
+	target := remoteWriteTarget{URL: srv.URL, Encoding: encodingPassthrough, Protocol: encodingPassthrough}
+	for code, retry := range map[int]bool{400: false, 429: true, 503: true} {
+		status = code
+		_, err := RelayPrometheusRemoteWrite("rw.encoding.snappy", target, nil, []byte("x"))
+		if err == nil || remoteWriteRetryable(err) != retry {
+			t.Errorf("status %d: got %v, retry %v", code, err, remoteWriteRetryable(err))
+		}
+	}
+	status = http.StatusAccepted
+	if _, err := RelayPrometheusRemoteWrite("rw.encoding.snappy", target, nil, []byte("x")); err != nil {
+		t.Errorf("expected 2xx to succeed: %v", err)
+	}
+}
+
+// Test the relay retries 429/5xx with backoff and leaves other 4xx alone
+func TestRemoteWriteRetry(t *testing.T) {
+	now := time.Now()
+	for value, want := range map[string]time.Duration{
+		"":     0,
+		"3":    3 * time.Second,
+		"-1":   0,
+		"soon": 0,
+		now.Add(time.Minute).UTC().Format(http.TimeFormat): time.Minute,
+	} {
+		// HTTP dates only have second precision
+		if got := parseRetryAfter(value, now.Truncate(time.Second)); got != want {
+			t.Errorf("Retry-After %q: got %v, want %v", value, got, want)
+		}
+	}
+
+	defer func(min, max time.Duration) {
+		remoteWriteMinBackoff, remoteWriteMaxBackoff = min, max
+	}(remoteWriteMinBackoff, remoteWriteMaxBackoff)
+	remoteWriteMinBackoff, remoteWriteMaxBackoff = time.Millisecond, 4*time.Millisecond
+	for attempt := 1; attempt < 6; attempt++ {
+		if d := remoteWriteBackoff(attempt, nil); d > remoteWriteMaxBackoff || d < remoteWriteMinBackoff/2 {
+			t.Errorf("attempt %d: backoff %v out of range", attempt, d)
+		}
+	}
+	if d := remoteWriteBackoff(1, &remoteWriteStatusError{StatusCode: 429, RetryAfter: time.Hour}); d != time.Hour {
+		t.Errorf("expected Retry-After to win, got %v", d)
+	}
+
+	var calls int
+	var fail []int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if len(fail) > 0 {
+			w.Header().Set("Retry-After", "0")
+			w.WriteHeader(fail[0])
+			fail = fail[1:]
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+	target := remoteWriteTarget{URL: srv.URL, Encoding: encodingPassthrough, Protocol: encodingPassthrough}
+
+	fail = []int{503, 429, 500}
+	if _, err := RelayPrometheusRemoteWrite("rw.encoding.snappy", target, nil, []byte("x")); err != nil || calls != 4 {
+		t.Errorf("expected success on 4th attempt, got %v after %d", err, calls)
+	}
+
+	calls, fail = 0, []int{400}
+	if _, err := RelayPrometheusRemoteWrite("rw.encoding.snappy", target, nil, []byte("x")); err == nil || calls != 1 {
+		t.Errorf("expected 400 not to be retried, got %v after %d", err, calls)
+	}
+
+	calls, fail = 0, []int{503, 503, 503, 503, 503, 503, 503}
+	if _, err := RelayPrometheusRemoteWrite("rw.encoding.snappy", target, nil, []byte("x")); err == nil || calls != remoteWriteMaxRetries+1 {
+		t.Errorf("expected give up after %d retries, got %v after %d", remoteWriteMaxRetries, err, calls)
+	}
+}
+
+// Test the relay spools while the downstream is down and replays in order
+func TestRemoteWriteSpool(t *testing.T) {
+	var down atomic.Bool
+	var mu sync.Mutex
+	var got []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if down.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		mu.Lock()
+		got = append(got, string(body))
+		mu.Unlock()
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+
+	defer func(dir string, retries int, interval time.Duration) {
+		spoolDir, remoteWriteMaxRetries, spoolRetryInterval = dir, retries, interval
+	}(spoolDir, remoteWriteMaxRetries, spoolRetryInterval)
+	spoolDir, remoteWriteMaxRetries, spoolRetryInterval = t.TempDir(), 0, 10*time.Millisecond
+
+	st, err := newSpooledTarget(remoteWriteTarget{URL: srv.URL, Encoding: encodingPassthrough, Protocol: encodingPassthrough})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer st.spool.Close()
+
+	// Same URL with other options gets its own spool and metrics
+	other, err := newSpooledTarget(remoteWriteTarget{URL: srv.URL, Encoding: encodingZstd, Protocol: encodingPassthrough})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.spool.Close()
+	if spoolPath(st.target) == spoolPath(other.target) {
+		t.Error("expected a spool directory per endpoint and options")
+	}
+
+	// Downstream down with the queue full, the replay is the only sender so
+	// nothing overtakes the messages waiting in the spool
+	defer func(size int) { remoteWriteQueueSize = size }(remoteWriteQueueSize)
+	remoteWriteQueueSize = 2
+	down.Store(true)
+	q := newRemoteWriteQueue(st.target, st.add)
+	for _, data := range []string{"a", "b", "x"} {
+		q.push(&nats.Msg{Subject: "rw.encoding.snappy", Data: []byte(data)})
+	}
+
+	stop, done := make(chan struct{}), make(chan struct{})
+	go func() {
+		st.replay(stop)
+		close(done)
+	}()
+	queued := make(chan struct{})
+	go func() {
+		q.run()
+		close(queued)
+	}()
+	for _, data := range []string{"c", "d", "e", "f"} {
+		q.msgs <- &nats.Msg{Subject: "rw.encoding.snappy", Data: []byte(data)}
+	}
+	close(q.msgs)
+	<-queued
+	if st.spool.Bytes() == 0 {
+		t.Fatal("expected writes to be spooled")
+	}
+
+	down.Store(false)
+	deadline := time.Now().Add(5 * time.Second)
+	for st.spool.Bytes() > 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	close(stop)
+	<-done
+	mu.Lock()
+	defer mu.Unlock()
+	if strings.Join(got, "") != "abcdef" {
+		t.Errorf("expected delivery in order, got %v", got)
+	}
+}
+
+// JetStream message recording how it was settled
+type fakeJSMessage struct {
+	meta    nats.MsgMetadata
+	settled string
+	delay   time.Duration
+}
+
+func (m *fakeJSMessage) Metadata() (*nats.MsgMetadata, error) { return &m.meta, nil }
+func (m *fakeJSMessage) Ack(...nats.AckOpt) error             { m.settled = "ack"; return nil }
+func (m *fakeJSMessage) Nak(...nats.AckOpt) error             { m.settled = "nak"; return nil }
+func (m *fakeJSMessage) Term(...nats.AckOpt) error            { m.settled = "term"; return nil }
+func (m *fakeJSMessage) InProgress(...nats.AckOpt) error      { return nil }
+func (m *fakeJSMessage) NakWithDelay(d time.Duration, _ ...nats.AckOpt) error {
+	m.settled, m.delay = "nak", d
+	return nil
+}
+
+// Test the JetStream relay settles messages by the downstream replies and
+// only redelivers to the downstreams that failed
+func TestRemoteWriteJetStreamSettle(t *testing.T) {
+	type downstream struct {
+		srv    *httptest.Server
+		status atomic.Int32
+		calls  atomic.Int32
+	}
+	var ds [2]*downstream
+	for i := range ds {
+		d := &downstream{}
+		d.srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			d.calls.Add(1)
+			w.WriteHeader(int(d.status.Load()))
+		}))
+		defer d.srv.Close()
+		ds[i] = d
+	}
+
+	defer func(retries, maxDeliver int, backoff []time.Duration) {
+		remoteWriteMaxRetries, jsMaxDeliver, jsBackoff = retries, maxDeliver, backoff
+	}(remoteWriteMaxRetries, jsMaxDeliver, jsBackoff)
+	remoteWriteMaxRetries, jsMaxDeliver, jsBackoff = 0, 3, []time.Duration{time.Second}
+
+	var targets []remoteWriteTarget
+	for _, d := range ds {
+		targets = append(targets, remoteWriteTarget{URL: d.srv.URL, Encoding: encodingPassthrough, Protocol: encodingPassthrough})
+	}
+	relay := newJSRelay(targets)
+
+	tests := []struct {
+		name      string
+		seq       uint64
+		delivered uint64
+		status    [2]int32
+		calls     [2]int32
+		want      string
+	}{
+		{"second downstream down", 1, 1, [2]int32{204, 503}, [2]int32{1, 1}, "nak"},
+		// The first one would now reject the batch as out of order
+		{"redelivery skips the first", 1, 2, [2]int32{400, 204}, [2]int32{0, 1}, "ack"},
+		{"4xx does not hide a 5xx", 2, 1, [2]int32{400, 503}, [2]int32{1, 1}, "nak"},
+		{"max deliver", 2, 3, [2]int32{400, 503}, [2]int32{1, 1}, "term"},
+		{"rejected for good", 3, 1, [2]int32{400, 204}, [2]int32{1, 1}, "term"},
+		{"all took it", 4, 1, [2]int32{200, 204}, [2]int32{1, 1}, "ack"},
+	}
+	for _, tt := range tests {
+		for i, d := range ds {
+			d.status.Store(tt.status[i])
+			d.calls.Store(0)
+		}
+		msg := &fakeJSMessage{}
+		msg.meta.NumDelivered, msg.meta.Sequence.Stream = tt.delivered, tt.seq
+		got := relay.handle(&nats.Msg{Subject: "rw.encoding.snappy", Data: []byte("x")}, msg)
+		if got != tt.want || msg.settled != tt.want {
+			t.Errorf("%s: got %q settled %q, want %q", tt.name, got, msg.settled, tt.want)
+		}
+		for i, d := range ds {
+			if d.calls.Load() != tt.calls[i] {
+				t.Errorf("%s: downstream %d got %d calls, want %d", tt.name, i, d.calls.Load(), tt.calls[i])
+			}
+		}
+		if tt.want == "nak" && msg.delay != time.Second {
+			t.Errorf("%s: nak delay %v", tt.name, msg.delay)
+		}
+	}
+	if len(relay.done) != 0 {
+		t.Errorf("expected settled messages to be forgotten, got %v", relay.done)
+	}
+
+	// A nak'd message redelivered to another relay is forgotten once overdue
+	ds[1].status.Store(503)
+	msg := &fakeJSMessage{}
+	msg.meta.NumDelivered, msg.meta.Sequence.Stream = 1, 5
+	if got := relay.handle(&nats.Msg{Subject: "rw.encoding.snappy", Data: []byte("x")}, msg); got != "nak" {
+		t.Fatalf("got %q", got)
+	}
+	d := relay.done[5]
+	if d == nil {
+		t.Fatal("expected nak'd message to be kept")
+	}
+	if window := time.Until(d.expires); window <= jsAckWait || window > time.Second+jsAckWait {
+		t.Errorf("unexpected expiry in %v", window)
+	}
+	relay.expire(d.expires)
+	if relay.done[5] == nil {
+		t.Errorf("expected message kept until it expires")
+	}
+	relay.expire(d.expires.Add(time.Millisecond))
+	if len(relay.done) != 0 {
+		t.Errorf("expected overdue message to be forgotten, got %v", relay.done)
+	}
+}
+
+// Test the relay queue never blocks the subscription and drops when full
+func TestRemoteWriteQueue(t *testing.T) {
+	defer func(size int) { remoteWriteQueueSize = size }(remoteWriteQueueSize)
+	remoteWriteQueueSize = 2
+	// Counter is global, start from zero on repeated runs
+	remoteWriteQueueDropped.DeleteLabelValues("http://queue.test")
+
+	var delivered []string
+	q := newRemoteWriteQueue(remoteWriteTarget{URL: "http://queue.test"}, func(msg *nats.Msg) error {
+		delivered = append(delivered, string(msg.Data))
+		return nil
+	})
+	for _, data := range []string{"a", "b", "c"} {
+		q.push(&nats.Msg{Data: []byte(data)})
+	}
+
+	close(q.msgs)
+	q.run()
+	if strings.Join(delivered, "") != "ab" {
+		t.Errorf("got delivered %v", delivered)
+	}
+	if got := testutil.ToFloat64(remoteWriteQueueDropped.WithLabelValues("http://queue.test")); got != 1 {
+		t.Errorf("expected 1 dropped, got %v", got)
+	}
+}
+
+// Test a failure without retries is not counted as giving up
+func TestRemoteWriteNoRetries(t *testing.T) {
+	defer func(retries int) { remoteWriteMaxRetries = retries }(remoteWriteMaxRetries)
+	remoteWriteMaxRetries = 0
+
+	calls := 0
+	err := retryRemoteWrite("http://noretry.test", func() error {
+		calls++
+		return &remoteWriteStatusError{StatusCode: 503}
+	})
+	if err == nil || calls != 1 {
+		t.Errorf("expected one failed attempt, got %v after %d", err, calls)
+	}
+	if got := testutil.ToFloat64(remoteWriteGiveUps.WithLabelValues("http://noretry.test")); got != 0 {
+		t.Errorf("expected no give up, got %v", got)
+	}
+}
+
+// JetStream context answering publishes with a fixed ack or error
+type fakeJetStream struct {
+	nats.JetStreamContext
+	err error
+}
+
+func (js fakeJetStream) PublishMsg(msg *nats.Msg, opts ...nats.PubOpt) (*nats.PubAck, error) {
+	if js.err != nil {
+		return nil, js.err
+	}
+	return &nats.PubAck{Stream: "test", Sequence: 1}, nil
+}
+
+// Test the written counts are only returned once JetStream stored the request
+func TestRemoteWriteHandlerWritten(t *testing.T) {
+	body := s2.EncodeSnappy(nil, testRemoteWriteV2())
+	post := func(pubsub *ProxyConn) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodPost, "/api/v1/write", bytes.NewReader(body))
+		r.Header.Set("Content-Encoding", "snappy")
+		r.Header.Set("Content-Type", "application/x-protobuf;proto="+remoteWriteProtoV2)
+		r.Header.Set(hdrRemoteWriteVersion, remoteWriteVersion2)
+		w := httptest.NewRecorder()
+		pubsub.RemoteWriteHandler(w, r)
+		return w
+	}
+
+	w := post(&ProxyConn{js: fakeJetStream{}})
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("got status %d: %s", w.Code, w.Body)
+	}
+	if w.Header().Get(hdrSamplesWritten) != "1" || w.Header().Get(hdrExemplarsWritten) != "1" {
+		t.Errorf("expected written counts, got %v", w.Header())
+	}
+
+	// Not stored, nothing written
+	w = post(&ProxyConn{js: fakeJetStream{err: nats.ErrNoStreamResponse}})
+	if w.Code != http.StatusInternalServerError {
+		t.Errorf("got status %d", w.Code)
+	}
+	if w.Header().Get(hdrSamplesWritten) != "" {
+		t.Errorf("expected no written counts, got %v", w.Header())
+	}
+}
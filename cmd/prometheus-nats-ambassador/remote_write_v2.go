@@ -0,0 +1,332 @@
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"fmt"
+	"mime"
+	"net/http"
+	"strconv"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// Prometheus Remote Write 1.0 and 2.0. The protobuf message is named by the
+// `proto` param of the `Content-Type`, 1.0 senders leave it out.
+// https://prometheus.io/docs/specs/prw/remote_write_spec_2_0/#protocol
+const (
+	remoteWriteVersion1 = "0.1.0"
+	remoteWriteVersion2 = "2.0.0"
+
+	remoteWriteProtoV1 = "prometheus.WriteRequest"
+	remoteWriteProtoV2 = "io.prometheus.write.v2.Request"
+
+	remoteWriteMediaType = "application/x-protobuf"
+
+	hdrRemoteWriteVersion = "X-Prometheus-Remote-Write-Version"
+
+	hdrSamplesWritten    = "X-Prometheus-Remote-Write-Samples-Written"
+	hdrHistogramsWritten = "X-Prometheus-Remote-Write-Histograms-Written"
+	hdrExemplarsWritten  = "X-Prometheus-Remote-Write-Exemplars-Written"
+)
+
+// Protobuf message of a remote write `Content-Type`
+func parseRemoteWriteProto(contentType string) (string, error) {
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return "", err
+	}
+	if mediaType != remoteWriteMediaType {
+		return "", fmt.Errorf("unsupported content type %q", mediaType)
+	}
+	switch params["proto"] {
+	case "", remoteWriteProtoV1:
+		return remoteWriteProtoV1, nil
+	case remoteWriteProtoV2:
+		return remoteWriteProtoV2, nil
+	}
+	return "", fmt.Errorf("unsupported proto message %q", params["proto"])
+}
+
+// Counts of a 2.0 request, returned to the sender in the `*-Written` headers
+type remoteWriteStats struct {
+	samples    int
+	histograms int
+	exemplars  int
+}
+
+func (s remoteWriteStats) setHeaders(h http.Header) {
+	h.Set(hdrSamplesWritten, strconv.Itoa(s.samples))
+	h.Set(hdrHistogramsWritten, strconv.Itoa(s.histograms))
+	h.Set(hdrExemplarsWritten, strconv.Itoa(s.exemplars))
+}
+
+// Field numbers of the messages we need, walked with protowire instead of
+// pulling in the generated Prometheus types.
+// https://github.com/prometheus/prometheus/blob/main/prompb/io/prometheus/write/v2/types.proto
+// https://github.com/prometheus/prometheus/blob/main/prompb/types.proto
+const (
+	// io.prometheus.write.v2.Request
+	v2RequestSymbols    protowire.Number = 4
+	v2RequestTimeseries protowire.Number = 5
+
+	// io.prometheus.write.v2.TimeSeries
+	v2SeriesLabelsRefs protowire.Number = 1
+	v2SeriesSamples    protowire.Number = 2
+	v2SeriesHistograms protowire.Number = 3
+	v2SeriesExemplars  protowire.Number = 4
+	v2SeriesMetadata   protowire.Number = 5
+
+	// io.prometheus.write.v2.Exemplar
+	v2ExemplarLabelsRefs protowire.Number = 1
+
+	// io.prometheus.write.v2.Metadata
+	v2MetadataType    protowire.Number = 1
+	v2MetadataHelpRef protowire.Number = 3
+	v2MetadataUnitRef protowire.Number = 4
+
+	// prometheus.WriteRequest
+	v1RequestTimeseries protowire.Number = 1
+	v1RequestMetadata   protowire.Number = 3
+
+	// prometheus.TimeSeries
+	v1SeriesLabels     protowire.Number = 1
+	v1SeriesSamples    protowire.Number = 2
+	v1SeriesExemplars  protowire.Number = 3
+	v1SeriesHistograms protowire.Number = 4
+
+	// prometheus.Label
+	v1LabelName  protowire.Number = 1
+	v1LabelValue protowire.Number = 2
+
+	// prometheus.MetricMetadata
+	v1MetadataType       protowire.Number = 1
+	v1MetadataFamilyName protowire.Number = 2
+	v1MetadataHelp       protowire.Number = 4
+	v1MetadataUnit       protowire.Number = 5
+)
+
+// Call fn for each field of a message, `val` is the payload for length
+// delimited fields and the raw encoded value otherwise
+func eachField(b []byte, fn func(num protowire.Number, typ protowire.Type, val []byte) error) error {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+		n = protowire.ConsumeFieldValue(num, typ, b)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		val := b[:n]
+		if typ == protowire.BytesType {
+			val, _ = protowire.ConsumeBytes(val)
+		}
+		if err := fn(num, typ, val); err != nil {
+			return err
+		}
+		b = b[n:]
+	}
+	return nil
+}
+
+func appendField(b []byte, num protowire.Number, typ protowire.Type, val []byte) []byte {
+	b = protowire.AppendTag(b, num, typ)
+	if typ == protowire.BytesType {
+		return protowire.AppendBytes(b, val)
+	}
+	return append(b, val...)
+}
+
+// Symbol references, packed or not
+func appendRefs(refs []uint32, typ protowire.Type, val []byte) ([]uint32, error) {
+	if typ == protowire.VarintType {
+		v, _ := protowire.ConsumeVarint(val)
+		return append(refs, uint32(v)), nil
+	}
+	for len(val) > 0 {
+		v, n := protowire.ConsumeVarint(val)
+		if n < 0 {
+			return nil, protowire.ParseError(n)
+		}
+		refs = append(refs, uint32(v))
+		val = val[n:]
+	}
+	return refs, nil
+}
+
+// Count the samples, histograms and exemplars of a decompressed 2.0 request
+func countRemoteWriteV2(raw []byte) (remoteWriteStats, error) {
+	var stats remoteWriteStats
+	err := eachField(raw, func(num protowire.Number, _ protowire.Type, series []byte) error {
+		if num != v2RequestTimeseries {
+			return nil
+		}
+		return eachField(series, func(num protowire.Number, _ protowire.Type, _ []byte) error {
+			switch num {
+			case v2SeriesSamples:
+				stats.samples++
+			case v2SeriesHistograms:
+				stats.histograms++
+			case v2SeriesExemplars:
+				stats.exemplars++
+			}
+			return nil
+		})
+	})
+	return stats, err
+}
+
+// Rewrite a decompressed 2.0 request as a 1.0 `WriteRequest` for downstreams
+// that do not speak 2.0 yet. Symbol references are resolved into labels and
+// per series metadata becomes one metadata entry per metric family. Created
+// timestamps have no 1.0 equivalent and are dropped.
+func downgradeRemoteWriteV2(raw []byte) ([]byte, error) {
+	var symbols []string
+	err := eachField(raw, func(num protowire.Number, _ protowire.Type, val []byte) error {
+		if num == v2RequestSymbols {
+			symbols = append(symbols, string(val))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// 1.0 labels from pairs of name and value references
+	labels := func(refs []uint32) ([]byte, map[string]string, error) {
+		if len(refs)%2 != 0 {
+			return nil, nil, fmt.Errorf("odd number of label references")
+		}
+		var out []byte
+		names := make(map[string]string, len(refs)/2)
+		for i := 0; i < len(refs); i += 2 {
+			if int(refs[i]) >= len(symbols) || int(refs[i+1]) >= len(symbols) {
+				return nil, nil, fmt.Errorf("label reference out of range")
+			}
+			name, value := symbols[refs[i]], symbols[refs[i+1]]
+			var label []byte
+			label = protowire.AppendTag(label, v1LabelName, protowire.BytesType)
+			label = protowire.AppendString(label, name)
+			label = protowire.AppendTag(label, v1LabelValue, protowire.BytesType)
+			label = protowire.AppendString(label, value)
+			out = appendField(out, v1SeriesLabels, protowire.BytesType, label)
+			names[name] = value
+		}
+		return out, names, nil
+	}
+	symbol := func(ref uint64) (string, error) {
+		if ref >= uint64(len(symbols)) {
+			return "", fmt.Errorf("symbol reference out of range")
+		}
+		return symbols[ref], nil
+	}
+
+	var out, metadata []byte
+	families := make(map[string]bool)
+	err = eachField(raw, func(num protowire.Number, _ protowire.Type, series []byte) error {
+		if num != v2RequestTimeseries {
+			return nil
+		}
+
+		var refs []uint32
+		var body, meta []byte
+		err := eachField(series, func(num protowire.Number, typ protowire.Type, val []byte) error {
+			var err error
+			switch num {
+			case v2SeriesLabelsRefs:
+				refs, err = appendRefs(refs, typ, val)
+			case v2SeriesSamples:
+				body = appendField(body, v1SeriesSamples, typ, val)
+			case v2SeriesHistograms:
+				// Same field numbers in both versions
+				body = appendField(body, v1SeriesHistograms, typ, val)
+			case v2SeriesExemplars:
+				var exemplar []byte
+				var exRefs []uint32
+				err = eachField(val, func(num protowire.Number, typ protowire.Type, val []byte) error {
+					var err error
+					if num == v2ExemplarLabelsRefs {
+						exRefs, err = appendRefs(exRefs, typ, val)
+					} else {
+						exemplar = appendField(exemplar, num, typ, val)
+					}
+					return err
+				})
+				if err != nil {
+					return err
+				}
+				exLabels, _, err := labels(exRefs)
+				if err != nil {
+					return err
+				}
+				exemplar = append(exLabels, exemplar...)
+				body = appendField(body, v1SeriesExemplars, typ, exemplar)
+			case v2SeriesMetadata:
+				meta = val
+			}
+			return err
+		})
+		if err != nil {
+			return err
+		}
+
+		seriesLabels, names, err := labels(refs)
+		if err != nil {
+			return err
+		}
+		out = appendField(out, v1RequestTimeseries, protowire.BytesType, append(seriesLabels, body...))
+
+		family := names["__name__"]
+		if meta == nil || family == "" || families[family] {
+			return nil
+		}
+		families[family] = true
+
+		var entry []byte
+		entry = protowire.AppendTag(entry, v1MetadataFamilyName, protowire.BytesType)
+		entry = protowire.AppendString(entry, family)
+		err = eachField(meta, func(num protowire.Number, typ protowire.Type, val []byte) error {
+			if typ != protowire.VarintType {
+				return nil
+			}
+			v, _ := protowire.ConsumeVarint(val)
+			switch num {
+			case v2MetadataType:
+				// Same enum values in both versions
+				entry = appendField(entry, v1MetadataType, typ, val)
+			case v2MetadataHelpRef, v2MetadataUnitRef:
+				s, err := symbol(v)
+				if err != nil {
+					return err
+				}
+				field := v1MetadataHelp
+				if num == v2MetadataUnitRef {
+					field = v1MetadataUnit
+				}
+				entry = protowire.AppendTag(entry, field, protowire.BytesType)
+				entry = protowire.AppendString(entry, s)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		metadata = appendField(metadata, v1RequestMetadata, protowire.BytesType, entry)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return append(out, metadata...), nil
+}
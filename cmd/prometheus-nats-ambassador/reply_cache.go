@@ -0,0 +1,162 @@
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Prometheus HA pairs scrape every target twice per interval. With a short
+// `cache_ttl` in the subscription metadata the exporter side keeps successful
+// replies for a moment and the second scrape is answered without going to the
+// exporter. Requests for the same key while a fetch is running wait for it
+// instead of starting another one.
+const (
+	// Subscription metadata key for the cache TTL, Go duration like `5s`
+	metadataCacheTTL = "cache_ttl"
+
+	// Reply header set to `hit` or `miss` for routes with a cache
+	hdrCache = "X-Ambassador-Cache"
+)
+
+type cacheEntry struct {
+	done    chan struct{}
+	reply   *exporterReply
+	err     error
+	fetched time.Time
+	expires time.Time
+}
+
+type replyCache struct {
+	mu      sync.Mutex
+	entries map[string]*cacheEntry
+	// Called when a request waits on a fetch in progress, for tests
+	joined func()
+}
+
+var exporterCache = &replyCache{entries: make(map[string]*cacheEntry)}
+
+// Cache key for a request, the query params are sorted and the scrape timeout
+// left out so replicas with different timeouts share an entry.
+func cacheKey(subject, endpoint string, params url.Values, accept string) string {
+	p := url.Values{}
+	for k, v := range params {
+		if k == "x-prometheus-scrape-timeout-seconds" {
+			continue
+		}
+		p[k] = v
+	}
+	return strings.Join([]string{subject, endpoint, p.Encode(), accept}, "\n")
+}
+
+// Return the cached reply for `key` or call `fetch` to get it. Only 2xx replies
+// are kept. The reply is a copy that is safe to modify, with `Age` and the
+// cache header set.
+func (c *replyCache) get(
+	key string,
+	ttl time.Duration,
+	fetch func() (*exporterReply, error),
+) (*exporterReply, bool, error) {
+	c.mu.Lock()
+	now := time.Now()
+	entry, ok := c.entries[key]
+	if ok && entry.expires.IsZero() {
+		// Fetch in progress, wait for it
+		c.mu.Unlock()
+		if c.joined != nil {
+			c.joined()
+		}
+		<-entry.done
+		reply := entry.copy()
+		// A fetch that was not kept is a miss for everyone waiting on it
+		if entry.expires.IsZero() {
+			if reply != nil {
+				reply.Header.Set(hdrCache, "miss")
+				reply.Header.Del("Age")
+			}
+			return reply, false, entry.err
+		}
+		return reply, true, entry.err
+	}
+	if ok && now.Before(entry.expires) {
+		c.mu.Unlock()
+		return entry.copy(), true, entry.err
+	}
+
+	// Drop anything expired while we hold the lock, wildcard subscriptions can
+	// otherwise grow the map without bound
+	for k, e := range c.entries {
+		if !e.expires.IsZero() && now.After(e.expires) {
+			delete(c.entries, k)
+		}
+	}
+	entry = &cacheEntry{done: make(chan struct{})}
+	c.entries[key] = entry
+	c.mu.Unlock()
+
+	reply, err := fetch()
+	if reply != nil && reply.Header == nil {
+		reply.Header = http.Header{}
+	}
+
+	c.mu.Lock()
+	if reply != nil {
+		stored := *reply
+		stored.Header = reply.Header.Clone()
+		entry.reply = &stored
+	}
+	entry.err = err
+	entry.fetched = time.Now()
+	if err == nil && reply != nil && reply.Status >= 200 && reply.Status <= 299 {
+		entry.expires = entry.fetched.Add(ttl)
+	} else {
+		delete(c.entries, key)
+	}
+	c.mu.Unlock()
+	close(entry.done)
+
+	if reply != nil {
+		reply.Header.Set(hdrCache, "miss")
+	}
+	return reply, false, err
+}
+
+// Copy of the cached reply, headers are cloned as the reply gets compressed
+// per request.
+func (e *cacheEntry) copy() *exporterReply {
+	if e.reply == nil {
+		return nil
+	}
+	reply := *e.reply
+	reply.Header = e.reply.Header.Clone()
+	reply.Header.Set(hdrCache, "hit")
+	reply.Header.Set("Age", strconv.Itoa(int(time.Since(e.fetched).Seconds())))
+	return &reply
+}
+
+// Parse the `cache_ttl` metadata, zero turns the cache off
+func parseCacheTTL(v string) (time.Duration, error) {
+	ttl, err := time.ParseDuration(v)
+	if err != nil {
+		return 0, err
+	}
+	if ttl < 0 {
+		return 0, fmt.Errorf("negative duration %v", v)
+	}
+	return ttl, nil
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Call `get` from `n` goroutines at once, the first one fetches and the rest
+// are known to wait on it before the fetch is let go
+func concurrentGets(
+	t *testing.T,
+	c *replyCache,
+	key string,
+	n int,
+	fetch func() (*exporterReply, error),
+	check func(reply *exporterReply, hit bool, err error),
+) {
+	t.Helper()
+	started := make(chan struct{})
+	release := make(chan struct{})
+	var once sync.Once
+	blocking := func() (*exporterReply, error) {
+		once.Do(func() { close(started) })
+		<-release
+		return fetch()
+	}
+
+	joined := make(chan struct{}, n)
+	c.joined = func() { joined <- struct{}{} }
+	defer func() { c.joined = nil }()
+
+	var wg sync.WaitGroup
+	get := func() {
+		defer wg.Done()
+		reply, hit, err := c.get(key, time.Minute, blocking)
+		check(reply, hit, err)
+	}
+	wg.Add(n)
+	go get()
+	<-started
+	for i := 1; i < n; i++ {
+		go get()
+	}
+	for i := 1; i < n; i++ {
+		<-joined
+	}
+	close(release)
+	wg.Wait()
+}
+
+// Test replies are cached per key, errors are not and concurrent requests
+// share a single fetch
+func TestReplyCache(t *testing.T) {
+	c := &replyCache{entries: make(map[string]*cacheEntry)}
+
+	var mu sync.Mutex
+	fetches, hits, misses := 0, 0, 0
+	fetch := func() (*exporterReply, error) {
+		mu.Lock()
+		fetches++
+		mu.Unlock()
+		return &exporterReply{Status: http.StatusOK, Body: []byte("up 1\n")}, nil
+	}
+
+	// Timeout param is left out of the key
+	key := cacheKey("io.prometheus.exporter.db1.9187", "http://localhost:9187/metrics",
+		url.Values{"b": {"2"}, "a": {"1"}, "x-prometheus-scrape-timeout-seconds": {"10"}}, "")
+	if other := cacheKey("io.prometheus.exporter.db1.9187", "http://localhost:9187/metrics",
+		url.Values{"a": {"1"}, "b": {"2"}}, ""); other != key {
+		t.Errorf("keys differ: %q != %q", key, other)
+	}
+
+	concurrentGets(t, c, key, 3, fetch, func(reply *exporterReply, hit bool, err error) {
+		if err != nil || string(reply.Body) != "up 1\n" {
+			t.Errorf("get: %v %v", reply, err)
+		}
+		mu.Lock()
+		if hit {
+			hits++
+		} else {
+			misses++
+		}
+		mu.Unlock()
+		reply.Header.Set("Content-Encoding", "zstd")
+	})
+	if hits != 2 || misses != 1 {
+		t.Errorf("expected one miss and two hits, got %d and %d", misses, hits)
+	}
+
+	reply, hit, _ := c.get(key, time.Minute, fetch)
+	if !hit || fetches != 1 {
+		t.Errorf("expected one fetch and a hit, got %d fetches hit %v", fetches, hit)
+	}
+	if reply.Header.Get(hdrCache) != "hit" || reply.Header.Get("Content-Encoding") != "" {
+		t.Errorf("unexpected headers %v", reply.Header)
+	}
+
+	// Failed fetches are not kept
+	failed := func() (*exporterReply, error) {
+		return &exporterReply{Status: http.StatusBadGateway}, errors.New("down")
+	}
+	for i := 0; i < 2; i++ {
+		if _, hit, err := c.get("failing", time.Minute, failed); hit || err == nil {
+			t.Errorf("expected uncached error, got hit %v err %v", hit, err)
+		}
+	}
+
+	// Waiters on a failed fetch are misses too
+	concurrentGets(t, c, "slow failing", 3, failed, func(reply *exporterReply, hit bool, err error) {
+		if hit || err == nil || reply.Header.Get(hdrCache) != "miss" {
+			t.Errorf("expected a miss with error, got hit %v err %v", hit, err)
+		}
+	})
+}
@@ -0,0 +1,185 @@
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+// Large exporters (kube-state-metrics, cAdvisor) can go over the NATS server
+// `max_payload` (default 1MB). Those replies are split in to chunks that are
+// published in order on the reply inbox, each chunk has a sequence number and
+// the last one is marked so the scraper side can tell if any went missing.
+const (
+	// Set by the scraper side to say it can reassemble chunked replies
+	hdrAcceptChunks = "X-Ambassador-Accept-Chunks"
+	// Chunk sequence number starting at 0
+	hdrChunkSeq = "X-Ambassador-Chunk-Seq"
+	// Set to `true` on the final chunk
+	hdrChunkLast = "X-Ambassador-Chunk-Last"
+	// Full size of the reply body, sent on the first chunk
+	hdrChunkLength = "X-Ambassador-Chunk-Length"
+
+	// Room left in each message for headers
+	chunkHeadroom = 8 * 1024
+)
+
+var errIncompleteReply = errors.New("incomplete chunked reply")
+
+// Send a reply to a request, splitting it in to chunks when the body is bigger
+// than the server allows in one message.
+func (pubsub *ProxyConn) RespondReply(msg *nats.Msg, reply *nats.Msg) error {
+	chunks := splitReply(msg, reply, pubsub.nc.MaxPayload())
+	if len(chunks) == 1 {
+		return msg.RespondMsg(chunks[0])
+	}
+	for seq, chunk := range chunks {
+		chunk.Subject = msg.Reply
+		if err := pubsub.nc.PublishMsg(chunk); err != nil {
+			return fmt.Errorf("chunk %d: %w", seq, err)
+		}
+	}
+	return nil
+}
+
+// Messages to send for a reply to `msg`, one unless the body has to be split
+func splitReply(msg *nats.Msg, reply *nats.Msg, maxPayload int64) []*nats.Msg {
+	chunkSize := int(maxPayload) - chunkHeadroom
+	if chunkSize <= 0 {
+		chunkSize = int(maxPayload) / 2
+	}
+
+	if len(reply.Data) <= chunkSize {
+		return []*nats.Msg{reply}
+	}
+
+	// Older scraper side ambassadors only read the first reply, fail the
+	// scrape rather than send back a truncated body.
+	if msg.Header.Get(hdrAcceptChunks) != "true" {
+		return []*nats.Msg{newReplyMsg(nil, fmt.Errorf(
+			"reply of %d bytes exceeds NATS max payload %d and requester does not accept chunks",
+			len(reply.Data),
+			maxPayload,
+		))}
+	}
+
+	var chunks []*nats.Msg
+	body := reply.Data
+	for seq := 0; len(body) > 0; seq++ {
+		n := min(chunkSize, len(body))
+
+		chunk := &nats.Msg{
+			Header: nats.Header{},
+			Data:   body[:n],
+		}
+		// Status and content headers only go out on the first chunk
+		if seq == 0 {
+			for k, v := range reply.Header {
+				chunk.Header[k] = v
+			}
+			chunk.Header.Set(hdrChunkLength, strconv.Itoa(len(reply.Data)))
+		}
+		// Every chunk names its sender so the scraper side can keep to one
+		chunk.Header.Set(hdrInstance, reply.Header.Get(hdrInstance))
+		chunk.Header.Set(hdrChunkSeq, strconv.Itoa(seq))
+		body = body[n:]
+		if len(body) == 0 {
+			chunk.Header.Set(hdrChunkLast, "true")
+		}
+		chunks = append(chunks, chunk)
+	}
+	return chunks
+}
+
+// Send a request and wait for the reply, reassembling the body if the reply
+// comes back in chunks. Returns `errIncompleteReply` if chunks are missing or
+// the stream did not finish before the timeout.
+func (pubsub *ProxyConn) RequestReply(req *nats.Msg, timeout time.Duration) (*nats.Msg, error) {
+	// Own inbox subscription as `nc.Request` only waits for one message
+	inbox := nats.NewInbox()
+	sub, err := pubsub.nc.SubscribeSync(inbox)
+	if err != nil {
+		return nil, err
+	}
+	defer sub.Unsubscribe()
+	// Reply size is bounded by the exporter, not by default pending limits
+	sub.SetPendingLimits(-1, -1)
+
+	req.Reply = inbox
+	if req.Header == nil {
+		req.Header = nats.Header{}
+	}
+	req.Header.Set(hdrAcceptChunks, "true")
+	if err := pubsub.nc.PublishMsg(req); err != nil {
+		return nil, err
+	}
+
+	return readReply(sub.NextMsg, timeout)
+}
+
+// Read a reply from the inbox with `next`, reassembling chunks. More than one
+// exporter side can be subscribed without a queue group and they all answer
+// on the same inbox, only messages from the first one to answer are used.
+func readReply(next func(timeout time.Duration) (*nats.Msg, error), timeout time.Duration) (*nats.Msg, error) {
+	deadline := time.Now().Add(timeout)
+
+	first, err := next(timeout)
+	if err != nil {
+		return nil, err
+	}
+	// Server tells us when nobody is subscribed to the subject
+	if len(first.Data) == 0 && first.Header.Get("Status") == "503" {
+		return nil, nats.ErrNoResponders
+	}
+	if first.Header.Get(hdrChunkSeq) == "" {
+		return first, nil
+	}
+	instance := first.Header.Get(hdrInstance)
+
+	var body bytes.Buffer
+	msg := first
+	for seq := 0; ; seq++ {
+		if got := msg.Header.Get(hdrChunkSeq); got != strconv.Itoa(seq) {
+			return nil, fmt.Errorf("%w: chunk %v out of sequence, expected %d", errIncompleteReply, got, seq)
+		}
+		body.Write(msg.Data)
+		if msg.Header.Get(hdrChunkLast) == "true" {
+			break
+		}
+
+		for {
+			msg, err = next(time.Until(deadline))
+			if err != nil {
+				return nil, fmt.Errorf("%w: received %d chunks: %v", errIncompleteReply, seq+1, err)
+			}
+			if msg.Header.Get(hdrInstance) == instance {
+				break
+			}
+		}
+	}
+
+	if want := first.Header.Get(hdrChunkLength); want != strconv.Itoa(body.Len()) {
+		return nil, fmt.Errorf("%w: got %d bytes, expected %v", errIncompleteReply, body.Len(), want)
+	}
+
+	return &nats.Msg{
+		Subject: first.Subject,
+		Header:  first.Header,
+		Data:    body.Bytes(),
+	}, nil
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+// Inbox that hands out queued messages, then times out
+func fakeInbox(msgs []*nats.Msg) func(time.Duration) (*nats.Msg, error) {
+	return func(time.Duration) (*nats.Msg, error) {
+		if len(msgs) == 0 {
+			return nil, nats.ErrTimeout
+		}
+		msg := msgs[0]
+		msgs = msgs[1:]
+		return msg, nil
+	}
+}
+
+// Split a reply of 10 chunks from `instance`
+func testChunks(t *testing.T, instance string, body []byte) []*nats.Msg {
+	t.Helper()
+	req := &nats.Msg{Header: nats.Header{hdrAcceptChunks: {"true"}}}
+	reply := &nats.Msg{Header: nats.Header{}, Data: body}
+	reply.Header.Set(hdrStatus, "200")
+	reply.Header.Set(hdrInstance, instance)
+
+	chunks := splitReply(req, reply, int64(chunkHeadroom+len(body)/10))
+	if len(chunks) != 10 {
+		t.Fatalf("got %d chunks, want 10", len(chunks))
+	}
+	return chunks
+}
+
+// Test a large reply is split and reassembled in full
+func TestReplyChunks(t *testing.T) {
+	body := bytes.Repeat([]byte("up 1\n"), 2000)
+	chunks := testChunks(t, "a", body)
+
+	for seq, chunk := range chunks {
+		if got := chunk.Header.Get(hdrChunkSeq); got != strconv.Itoa(seq) {
+			t.Errorf("chunk %d has seq %q", seq, got)
+		}
+		if last := chunk.Header.Get(hdrChunkLast) == "true"; last != (seq == len(chunks)-1) {
+			t.Errorf("chunk %d last %v", seq, last)
+		}
+		if seq > 0 && chunk.Header.Get(hdrStatus) != "" {
+			t.Errorf("chunk %d repeats the status header", seq)
+		}
+	}
+
+	got, err := readReply(fakeInbox(chunks), time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got.Data, body) {
+		t.Errorf("got %d bytes, want %d", len(got.Data), len(body))
+	}
+	if got.Header.Get(hdrStatus) != "200" {
+		t.Errorf("status header not kept: %v", got.Header)
+	}
+
+	// Small replies go out as they are
+	small := &nats.Msg{Data: []byte("up 1\n")}
+	if out := splitReply(&nats.Msg{}, small, 1024*1024); len(out) != 1 || out[0] != small {
+		t.Errorf("expected the reply unchanged, got %v", out)
+	}
+	if got, err := readReply(fakeInbox([]*nats.Msg{small}), time.Second); err != nil || got != small {
+		t.Errorf("got %v, %v", got, err)
+	}
+}
+
+// Test lost, reordered or short chunks fail the reply
+func TestReplyChunksIncomplete(t *testing.T) {
+	body := bytes.Repeat([]byte("up 1\n"), 2000)
+
+	reordered := testChunks(t, "a", body)
+	reordered[1], reordered[2] = reordered[2], reordered[1]
+
+	missingLast := testChunks(t, "a", body)
+	missingLast = missingLast[:len(missingLast)-1]
+
+	badLength := testChunks(t, "a", body)
+	badLength[0].Header.Set(hdrChunkLength, strconv.Itoa(len(body)+1))
+
+	for name, chunks := range map[string][]*nats.Msg{
+		"out of sequence": reordered,
+		"missing last":    missingLast,
+		"total length":    badLength,
+	} {
+		if _, err := readReply(fakeInbox(chunks), time.Second); !errors.Is(err, errIncompleteReply) {
+			t.Errorf("%s: expected incomplete reply, got %v", name, err)
+		}
+	}
+}
+
+// Test chunks from a second responder on the same inbox are left out
+func TestReplyChunksFirstResponder(t *testing.T) {
+	bodyA := bytes.Repeat([]byte("a 1\n"), 2500)
+	bodyB := bytes.Repeat([]byte("b 1\n"), 2500)
+	a, b := testChunks(t, "a", bodyA), testChunks(t, "b", bodyB)
+
+	var interleaved []*nats.Msg
+	for i := range a {
+		interleaved = append(interleaved, a[i], b[i])
+	}
+	got, err := readReply(fakeInbox(interleaved), time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got.Data, bodyA) {
+		t.Errorf("reply mixed in chunks of the second responder")
+	}
+}
+
+// Test an older requester gets an error instead of a truncated reply
+func TestReplyChunksNotAccepted(t *testing.T) {
+	reply := &nats.Msg{Data: bytes.Repeat([]byte("up 1\n"), 2000)}
+	out := splitReply(&nats.Msg{Header: nats.Header{}}, reply, chunkHeadroom+1000)
+	if len(out) != 1 {
+		t.Fatalf("got %d messages, want 1", len(out))
+	}
+	if out[0].Header.Get(hdrStatus) != "502" || out[0].Header.Get(hdrError) == "" || len(out[0].Data) != 0 {
+		t.Errorf("expected error reply, got %v %q", out[0].Header, out[0].Data)
+	}
+}
+
+// Test the server no responders status is reported as such
+func TestReplyNoResponders(t *testing.T) {
+	status := &nats.Msg{Header: nats.Header{"Status": {"503"}}}
+	if _, err := readReply(fakeInbox([]*nats.Msg{status}), time.Second); !errors.Is(err, nats.ErrNoResponders) {
+		t.Errorf("got %v", err)
+	}
+}
@@ -0,0 +1,214 @@
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/insikl/prometheus-nats-ambassador/internal/models"
+)
+
+// Exporters behind exporter-toolkit web-config need credentials and/or TLS.
+// Set per subscription with metadata, secrets are only ever read from files
+// and picked up again when the files change so they can be rotated without a
+// restart.
+// https://github.com/prometheus/exporter-toolkit/blob/master/docs/web-configuration.md
+const (
+	metadataBasicAuthUser     = "basic_auth_username"
+	metadataBasicAuthPassFile = "basic_auth_password_file"
+	metadataBearerTokenFile   = "bearer_token_file"
+	metadataTLSCAFile         = "tls_ca_file"
+	metadataTLSCertFile       = "tls_cert_file"
+	metadataTLSKeyFile        = "tls_key_file"
+	metadataTLSServerName     = "tls_server_name"
+	metadataTLSInsecure       = "tls_insecure_skip_verify"
+)
+
+// Auth and TLS settings for requests to the exporter of a route
+type routeAuth struct {
+	username     string
+	passwordFile string
+	tokenFile    string
+
+	caFile     string
+	certFile   string
+	keyFile    string
+	serverName string
+	insecure   bool
+
+	// Transport built from the TLS files, rebuilt when any of them change
+	mu        sync.Mutex
+	transport *http.Transport
+	modTime   time.Time
+}
+
+// Build the auth settings from subscription metadata, nil when none are set.
+// Files are read once here so mistakes show up at startup.
+func newRouteAuth(sub models.Subscription) (*routeAuth, error) {
+	md := sub.Metadata
+	auth := &routeAuth{
+		username:     md[metadataBasicAuthUser],
+		passwordFile: md[metadataBasicAuthPassFile],
+		tokenFile:    md[metadataBearerTokenFile],
+		caFile:       md[metadataTLSCAFile],
+		certFile:     md[metadataTLSCertFile],
+		keyFile:      md[metadataTLSKeyFile],
+		serverName:   md[metadataTLSServerName],
+	}
+	if v, ok := md[metadataTLSInsecure]; ok {
+		insecure, err := strconv.ParseBool(v)
+		if err != nil {
+			return nil, fmt.Errorf("metadata %v: %w", metadataTLSInsecure, err)
+		}
+		auth.insecure = insecure
+	}
+
+	if auth.username == "" && auth.passwordFile == "" && auth.tokenFile == "" && !auth.hasTLS() {
+		return nil, nil
+	}
+	if auth.tokenFile != "" && (auth.username != "" || auth.passwordFile != "") {
+		return nil, errors.New("only one of basic auth or bearer token can be set")
+	}
+	if auth.passwordFile != "" && auth.username == "" {
+		return nil, fmt.Errorf("metadata %v requires %v", metadataBasicAuthPassFile, metadataBasicAuthUser)
+	}
+	if (auth.certFile == "") != (auth.keyFile == "") {
+		return nil, fmt.Errorf("metadata %v and %v must be set together", metadataTLSCertFile, metadataTLSKeyFile)
+	}
+
+	if err := auth.apply(&http.Request{Header: http.Header{}}); err != nil {
+		return nil, err
+	}
+	if _, err := auth.roundTripper(); err != nil {
+		return nil, err
+	}
+	return auth, nil
+}
+
+func (auth *routeAuth) hasTLS() bool {
+	return auth.caFile != "" || auth.certFile != "" || auth.serverName != "" || auth.insecure
+}
+
+// Read a secret file, trailing newlines are dropped
+func readSecretFile(file string) (string, error) {
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(b), "\r\n"), nil
+}
+
+// Set credentials on a request, secret files are read on every request so a
+// rotated secret is used straight away.
+func (auth *routeAuth) apply(req *http.Request) error {
+	if auth == nil {
+		return nil
+	}
+	if auth.tokenFile != "" {
+		token, err := readSecretFile(auth.tokenFile)
+		if err != nil {
+			return fmt.Errorf("bearer token: %w", err)
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	if auth.username != "" {
+		password := ""
+		if auth.passwordFile != "" {
+			p, err := readSecretFile(auth.passwordFile)
+			if err != nil {
+				return fmt.Errorf("basic auth password: %w", err)
+			}
+			password = p
+		}
+		req.SetBasicAuth(auth.username, password)
+	}
+	return nil
+}
+
+// Latest modification time of the TLS files
+func (auth *routeAuth) tlsModTime() (time.Time, error) {
+	var latest time.Time
+	for _, file := range []string{auth.caFile, auth.certFile, auth.keyFile} {
+		if file == "" {
+			continue
+		}
+		fi, err := os.Stat(file)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if fi.ModTime().After(latest) {
+			latest = fi.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+// Transport for requests to the exporter. Routes without TLS settings share
+// the default transport.
+func (auth *routeAuth) roundTripper() (http.RoundTripper, error) {
+	if auth == nil || !auth.hasTLS() {
+		return http.DefaultTransport, nil
+	}
+
+	auth.mu.Lock()
+	defer auth.mu.Unlock()
+
+	modTime, err := auth.tlsModTime()
+	if err != nil {
+		return nil, fmt.Errorf("tls: %w", err)
+	}
+	if auth.transport != nil && modTime.Equal(auth.modTime) {
+		return auth.transport, nil
+	}
+
+	cfg := &tls.Config{
+		ServerName:         auth.serverName,
+		InsecureSkipVerify: auth.insecure,
+	}
+	if auth.caFile != "" {
+		pem, err := os.ReadFile(auth.caFile)
+		if err != nil {
+			return nil, fmt.Errorf("tls ca: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("tls ca: no certificates in %v", auth.caFile)
+		}
+		cfg.RootCAs = pool
+	}
+	if auth.certFile != "" {
+		cert, err := tls.LoadX509KeyPair(auth.certFile, auth.keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("tls client certificate: %w", err)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+
+	// Connections made with the old files are closed so the new ones are used
+	if auth.transport != nil {
+		auth.transport.CloseIdleConnections()
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = cfg
+	auth.transport = transport
+	auth.modTime = modTime
+	return transport, nil
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/insikl/prometheus-nats-ambassador/internal/models"
+)
+
+// Test bearer token and private CA settings, and that a rotated token is used
+func TestRouteAuth(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer s3cret" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		w.Write([]byte("up 1\n"))
+	}))
+	defer srv.Close()
+
+	dir := t.TempDir()
+	caFile := filepath.Join(dir, "ca.pem")
+	tokenFile := filepath.Join(dir, "token")
+	ca := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw})
+	if err := os.WriteFile(caFile, ca, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(tokenFile, []byte("wrong\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	route, err := newExporterRoute(models.Subscription{
+		Topic: "io.prometheus.exporter.target1_example_com.9100",
+		Metadata: map[string]string{
+			"bearer_token_file": tokenFile,
+			"tls_ca_file":       caFile,
+			"tls_server_name":   "example.com",
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reply, err := ProxyPrometheusRequest("test", srv.URL, "", http.Header{}, route)
+	if err == nil || reply.Status != http.StatusUnauthorized {
+		t.Fatalf("expected 401, got %v %v", reply.Status, err)
+	}
+
+	if err := os.WriteFile(tokenFile, []byte("s3cret\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	reply, err = ProxyPrometheusRequest("test", srv.URL, "", http.Header{}, route)
+	if err != nil || string(reply.Body) != "up 1\n" {
+		t.Fatalf("got %v %q", err, reply.Body)
+	}
+
+	// Invalid combinations are rejected at startup
+	for _, md := range []map[string]string{
+		{"bearer_token_file": tokenFile, "basic_auth_username": "prom"},
+		{"tls_cert_file": caFile},
+		{"bearer_token_file": filepath.Join(dir, "missing")},
+	} {
+		if _, err := newExporterRoute(models.Subscription{Topic: "t", Metadata: md}); err == nil {
+			t.Errorf("expected error for %v", md)
+		}
+	}
+}
@@ -0,0 +1,184 @@
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/insikl/prometheus-nats-ambassador/internal/logger"
+)
+
+// A dead exporter otherwise makes every scrape wait for the HTTP timeout. The
+// exporter side checks the default endpoint of each route in the background
+// and while it is down replies with a 503 straight away. By default the check
+// only connects (TCP, unix socket) or looks for the file, set the metadata
+// `health_url` for a HTTP GET that has to return 2xx instead.
+var (
+	healthInterval = 15 * time.Second
+	healthTimeout  = 3 * time.Second
+)
+
+// Subscription metadata key for a HTTP health check URL
+const metadataHealthURL = "health_url"
+
+// Health of the default endpoint of a route
+type routeHealth struct {
+	// Endpoint requests are failed fast for while down
+	endpoint string
+	// HTTP URL to check, empty to connect to the endpoint
+	url string
+
+	mu    sync.Mutex
+	down  bool
+	since time.Time
+	err   error
+}
+
+// Health check for a route, nil for wildcard routes as their endpoint depends
+// on the subject
+func newRouteHealth(route *exporterRoute) *routeHealth {
+	if route.def.tmpl != nil || route.def.raw == "" {
+		return nil
+	}
+	return &routeHealth{
+		endpoint: route.def.raw,
+		url:      route.sub.Metadata[metadataHealthURL],
+	}
+}
+
+// Error to fail requests to `endpoint` with while the route is down
+func (h *routeHealth) failFast(endpoint string) error {
+	if h == nil || endpoint != h.endpoint {
+		return nil
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if !h.down {
+		return nil
+	}
+	return fmt.Errorf("exporter down since %v: %v", h.since.Format(time.RFC3339), h.err)
+}
+
+// Run one check and record the result
+func (h *routeHealth) check(route *exporterRoute) {
+	err := h.probe(route)
+
+	h.mu.Lock()
+	changed := h.down != (err != nil)
+	if changed {
+		h.since = time.Now()
+	}
+	h.down, h.err = err != nil, err
+	h.mu.Unlock()
+
+	if err != nil {
+		routeUp.WithLabelValues(route.sub.Topic).Set(0)
+		if changed {
+			logger.Warn("Route [%v] down: %v", route.sub.Topic, err)
+		}
+	} else {
+		routeUp.WithLabelValues(route.sub.Topic).Set(1)
+		if changed {
+			logger.Info("Route [%v] up", route.sub.Topic)
+		}
+	}
+}
+
+func (h *routeHealth) probe(route *exporterRoute) error {
+	ctx, cancel := context.WithTimeout(context.Background(), healthTimeout)
+	defer cancel()
+
+	if h.url != "" {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, h.url, nil)
+		if err != nil {
+			return err
+		}
+		req.Header.Set("User-Agent", userAgent)
+		if err := route.auth.apply(req); err != nil {
+			return err
+		}
+		transport, err := route.auth.roundTripper()
+		if err != nil {
+			return err
+		}
+		resp, err := (&http.Client{Transport: transport}).Do(req)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode < 200 || resp.StatusCode > 299 {
+			return fmt.Errorf("health check returned %s", resp.Status)
+		}
+		return nil
+	}
+
+	u, err := url.Parse(h.endpoint)
+	if err != nil {
+		return err
+	}
+	var d net.Dialer
+	switch u.Scheme {
+	case "file", "exec":
+		_, err := os.Stat(u.Path)
+		return err
+	case "unix":
+		sock, _ := unixSocketURL(u)
+		conn, err := d.DialContext(ctx, "unix", sock)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	}
+
+	port := u.Port()
+	if port == "" {
+		port = schemeDefaultPorts[u.Scheme]
+	}
+	conn, err := d.DialContext(ctx, "tcp", net.JoinHostPort(u.Hostname(), port))
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+// Check every route with a health check until the connection is closed
+func (pubsub *ProxyConn) runHealthChecks(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		var wg sync.WaitGroup
+		for _, route := range topicMap {
+			if route.health == nil {
+				continue
+			}
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				route.health.check(route)
+			}()
+		}
+		wg.Wait()
+
+		<-ticker.C
+		if pubsub.nc.IsClosed() {
+			return
+		}
+	}
+}
@@ -0,0 +1,562 @@
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+	"unicode"
+
+	"github.com/insikl/prometheus-nats-ambassador/internal/models"
+)
+
+// Request details available to a route rule `match` expression. Built from the
+// NATS message on the exporter side, query string is the message body and the
+// path/headers are carried as NATS message headers.
+type routeRequest struct {
+	Subject string
+	Path    string
+	Query   url.Values
+	Header  http.Header
+}
+
+// Compiled `match` expression, returns true if the request matches.
+type routeMatcher func(req routeRequest) bool
+
+type routeRule struct {
+	match routeMatcher
+	path  *routeEndpoint
+}
+
+// Upstream URL of a route, wildcard subscriptions can use a template that is
+// filled in from the subject of each message.
+//
+//	{{token 4}}    4th token of the subject, negative counts from the end
+//	{{subject}}    full subject
+//	{{replace "_" "." (token 4)}}
+//
+// Example: `http://{{token 4}}.localnet:9100/metrics` for the topic
+// `io.prometheus.exporter.*.9100`
+//
+// Subjects come from scrape requests, so tokens are limited to hostname
+// characters and the rendered URL has to keep the scheme, host and path the
+// template spells out. Token values can not add `/`, `#`, `@` and friends to
+// point the exporter side at another host.
+type routeEndpoint struct {
+	raw  string
+	tmpl *template.Template
+	// Anchored pattern of the rendered endpoint, each template action
+	// stands for a run of token characters
+	pattern *regexp.Regexp
+	scheme  string
+}
+
+// Characters allowed in a subject token used in a template
+var routeTokenRegexp = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// What a template action can expand to, tokens plus `.` from `replace` or
+// `subject`
+const routeValueClass = `[A-Za-z0-9_.-]*`
+
+// Stand-in for template values when building the pattern
+const routeSentinel = "\x00"
+
+// Template functions, replaced per message with ones bound to the subject
+var routeFuncs = template.FuncMap{
+	"token":   func(n int) (string, error) { return "", nil },
+	"subject": func() string { return "" },
+	"replace": func(old, new, s string) string { return strings.ReplaceAll(s, old, new) },
+}
+
+func newRouteEndpoint(raw string) (*routeEndpoint, error) {
+	e := &routeEndpoint{raw: raw}
+	if strings.Contains(raw, "{{") {
+		tmpl, err := template.New("route").Funcs(routeFuncs).Parse(raw)
+		if err != nil {
+			return nil, err
+		}
+		e.tmpl = tmpl
+		if err := e.compilePattern(); err != nil {
+			return nil, err
+		}
+	}
+	return e, nil
+}
+
+// Render the template with a sentinel for every value and turn the result
+// into a pattern the real endpoints have to match
+func (e *routeEndpoint) compilePattern() error {
+	tmpl, err := e.tmpl.Clone()
+	if err != nil {
+		return err
+	}
+	tmpl.Funcs(template.FuncMap{
+		"token":   func(n int) (string, error) { return routeSentinel, nil },
+		"subject": func() string { return routeSentinel },
+	})
+	var out strings.Builder
+	if err := tmpl.Execute(&out, nil); err != nil {
+		return err
+	}
+
+	parts := strings.Split(out.String(), routeSentinel)
+	for i := range parts {
+		parts[i] = regexp.QuoteMeta(parts[i])
+	}
+	e.pattern, err = regexp.Compile("^" + strings.Join(parts, routeValueClass) + "$")
+	if err != nil {
+		return err
+	}
+	if scheme, _, ok := strings.Cut(out.String(), "://"); ok && !strings.Contains(scheme, routeSentinel) {
+		e.scheme = strings.ToLower(scheme)
+	}
+	return nil
+}
+
+// Fill in the endpoint for a subject, plain endpoints are returned as is
+func (e *routeEndpoint) render(subject string) (string, error) {
+	if e.tmpl == nil {
+		return e.raw, nil
+	}
+	tokens := strings.Split(subject, ".")
+
+	tmpl, err := e.tmpl.Clone()
+	if err != nil {
+		return "", err
+	}
+	tmpl.Funcs(template.FuncMap{
+		"token": func(n int) (string, error) {
+			// 1 based like NATS subject mapping, negative from the end
+			i := n - 1
+			if n < 0 {
+				i = len(tokens) + n
+			}
+			if n == 0 || i < 0 || i >= len(tokens) {
+				return "", fmt.Errorf("no token %d in subject %q", n, subject)
+			}
+			if !routeTokenRegexp.MatchString(tokens[i]) {
+				return "", fmt.Errorf("invalid token %q in subject %q", tokens[i], subject)
+			}
+			return tokens[i], nil
+		},
+		"subject": func() (string, error) {
+			for _, token := range tokens {
+				if !routeTokenRegexp.MatchString(token) {
+					return "", fmt.Errorf("invalid token %q in subject %q", token, subject)
+				}
+			}
+			return subject, nil
+		},
+	})
+
+	var out strings.Builder
+	if err := tmpl.Execute(&out, nil); err != nil {
+		return "", err
+	}
+
+	// Values can not hold URL delimiters, so matching the pattern keeps the
+	// host and path of the template
+	endpoint := out.String()
+	if !e.pattern.MatchString(endpoint) {
+		return "", fmt.Errorf("endpoint %q for subject %q does not match the route template", endpoint, subject)
+	}
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return "", fmt.Errorf("endpoint for subject %q: %w", subject, err)
+	}
+	if e.scheme != "" && strings.ToLower(u.Scheme) != e.scheme {
+		return "", fmt.Errorf("endpoint %q for subject %q changes the scheme", endpoint, subject)
+	}
+	// `replace` can turn tokens in to `..`, which would leave the directory of
+	// a `file://` or `exec://` template
+	for _, seg := range strings.Split(u.Path, "/") {
+		if seg == ".." {
+			return "", fmt.Errorf("endpoint %q for subject %q leaves the route template path", endpoint, subject)
+		}
+	}
+	return endpoint, nil
+}
+
+// Subscription with the route rules compiled, rules are evaluated in order and
+// the first match wins. If nothing matches `Route.Default` is used.
+// https://docs.dapr.io/developing-applications/building-blocks/pubsub/howto-route-messages/
+type exporterRoute struct {
+	sub   models.Subscription
+	rules []routeRule
+	// Queue group to subscribe with, empty for a plain subscription
+	queue string
+	// Default endpoint, may be a template for wildcard topics
+	def *routeEndpoint
+	// Worker pool size and in-flight limit
+	concurrency int
+	maxInflight int
+	// Keep successful replies this long, zero for no cache
+	cacheTTL time.Duration
+	// Credentials and TLS for the exporter, nil for none
+	auth *routeAuth
+	// Limits for `exec://` endpoints
+	exec execOptions
+	// Relabeling of the exporter reply, nil for none
+	relabel *replyRelabel
+	// Background check of the default endpoint, nil for wildcard routes
+	health *routeHealth
+}
+
+// Subscription metadata key to set the queue group, overrides `-queue`
+const metadataQueue = "queue"
+
+func newExporterRoute(sub models.Subscription) (*exporterRoute, error) {
+	route := &exporterRoute{
+		sub:         sub,
+		queue:       queueGroup,
+		concurrency: routeConcurrency,
+		maxInflight: routeMaxInflight,
+	}
+	if q, ok := sub.Metadata[metadataQueue]; ok {
+		route.queue = q
+	}
+	for key, n := range map[string]*int{
+		metadataConcurrency: &route.concurrency,
+		metadataMaxInflight: &route.maxInflight,
+	} {
+		if v, ok := sub.Metadata[key]; ok {
+			i, err := strconv.Atoi(v)
+			if err != nil {
+				return nil, fmt.Errorf("topic [%v] metadata %v: %w", sub.Topic, key, err)
+			}
+			*n = i
+		}
+	}
+	if v, ok := sub.Metadata[metadataCacheTTL]; ok {
+		ttl, err := parseCacheTTL(v)
+		if err != nil {
+			return nil, fmt.Errorf("topic [%v] metadata %v: %w", sub.Topic, metadataCacheTTL, err)
+		}
+		route.cacheTTL = ttl
+	}
+	auth, err := newRouteAuth(sub)
+	if err != nil {
+		return nil, fmt.Errorf("topic [%v]: %w", sub.Topic, err)
+	}
+	route.auth = auth
+	if route.exec, err = newExecOptions(sub); err != nil {
+		return nil, fmt.Errorf("topic [%v]: %w", sub.Topic, err)
+	}
+	if route.relabel, err = newReplyRelabel(sub); err != nil {
+		return nil, fmt.Errorf("topic [%v]: %w", sub.Topic, err)
+	}
+	if route.concurrency < 1 {
+		return nil, fmt.Errorf("topic [%v] concurrency must be at least 1", sub.Topic)
+	}
+	if route.maxInflight < route.concurrency {
+		route.maxInflight = route.concurrency
+	}
+	for i, rule := range sub.Route.Rules {
+		match, err := compileRouteMatch(rule.Match)
+		if err != nil {
+			return nil, fmt.Errorf("topic [%v] rule %d: %w", sub.Topic, i, err)
+		}
+		if rule.Path == "" {
+			return nil, fmt.Errorf("topic [%v] rule %d: missing path", sub.Topic, i)
+		}
+		path, err := newRouteEndpoint(rule.Path)
+		if err != nil {
+			return nil, fmt.Errorf("topic [%v] rule %d: %w", sub.Topic, i, err)
+		}
+		route.rules = append(route.rules, routeRule{match: match, path: path})
+	}
+
+	def, err := newRouteEndpoint(sub.Route.Default)
+	if err != nil {
+		return nil, fmt.Errorf("topic [%v] default: %w", sub.Topic, err)
+	}
+	route.def = def
+	route.health = newRouteHealth(route)
+	return route, nil
+}
+
+// Check if the subscription topic has `*` or `>` wildcard tokens
+func (route *exporterRoute) wildcard() bool {
+	return isWildcardSubject(route.sub.Topic)
+}
+
+func isWildcardSubject(subj string) bool {
+	for _, token := range strings.Split(subj, ".") {
+		if token == "*" || token == ">" {
+			return true
+		}
+	}
+	return false
+}
+
+// Get upstream endpoint for the request, first matching rule or default.
+// Templates are filled in from the subject of the request.
+func (route *exporterRoute) resolve(req routeRequest) (string, error) {
+	for _, rule := range route.rules {
+		if rule.match(req) {
+			return rule.path.render(req.Subject)
+		}
+	}
+	return route.def.render(req.Subject)
+}
+
+// Compile a route rule `match` expression. Grammar is intentionally small:
+//
+//	expr  := and { "||" and }
+//	and   := unary { "&&" unary }
+//	unary := "!" unary | "(" expr ")" | field [ op "string" ]
+//	op    := "==" | "!=" | "=~" | "!~"
+//	field := path | query.<name> | header.<name>
+//
+// A field on its own is true when it is set to a non-empty value. Regular
+// expressions are fully anchored the same as Prometheus relabel regex. Query
+// params and headers with multiple values match if any of the values match.
+//
+// Examples:
+//
+//	query.module == "icmp"
+//	path == "/metrics/cadvisor" || query.collect[] =~ "cpu|meminfo"
+//	header.accept =~ ".*openmetrics.*" && !query.debug
+func compileRouteMatch(expr string) (routeMatcher, error) {
+	tokens, err := lexRouteMatch(expr)
+	if err != nil {
+		return nil, err
+	}
+	if len(tokens) == 0 {
+		return nil, fmt.Errorf("empty match expression")
+	}
+	p := &matchParser{tokens: tokens}
+	m, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.tokens) {
+		return nil, fmt.Errorf("unexpected %q in match expression", p.tokens[p.pos].val)
+	}
+	return m, nil
+}
+
+type matchTokenKind int
+
+const (
+	tokField matchTokenKind = iota
+	tokString
+	tokOp
+)
+
+type matchToken struct {
+	kind matchTokenKind
+	val  string
+}
+
+func lexRouteMatch(expr string) ([]matchToken, error) {
+	var tokens []matchToken
+	for i := 0; i < len(expr); {
+		c := expr[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case c == '"' || c == '\'':
+			// Find closing quote, skipping escaped characters
+			j := i + 1
+			for ; j < len(expr) && expr[j] != c; j++ {
+				if expr[j] == '\\' {
+					j++
+				}
+			}
+			if j >= len(expr) {
+				return nil, fmt.Errorf("unterminated string in match expression")
+			}
+			val := expr[i+1 : j]
+			if c == '"' {
+				s, err := strconv.Unquote(expr[i : j+1])
+				if err != nil {
+					return nil, fmt.Errorf("invalid string %s: %w", expr[i:j+1], err)
+				}
+				val = s
+			}
+			tokens = append(tokens, matchToken{tokString, val})
+			i = j + 1
+		case strings.HasPrefix(expr[i:], "=="), strings.HasPrefix(expr[i:], "!="),
+			strings.HasPrefix(expr[i:], "=~"), strings.HasPrefix(expr[i:], "!~"),
+			strings.HasPrefix(expr[i:], "&&"), strings.HasPrefix(expr[i:], "||"):
+			tokens = append(tokens, matchToken{tokOp, expr[i : i+2]})
+			i += 2
+		case c == '!' || c == '(' || c == ')':
+			tokens = append(tokens, matchToken{tokOp, string(c)})
+			i++
+		case isFieldChar(rune(c)):
+			j := i
+			for j < len(expr) && isFieldChar(rune(expr[j])) {
+				j++
+			}
+			tokens = append(tokens, matchToken{tokField, expr[i:j]})
+			i = j
+		default:
+			return nil, fmt.Errorf("unexpected character %q in match expression", c)
+		}
+	}
+	return tokens, nil
+}
+
+func isFieldChar(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r) ||
+		r == '.' || r == '_' || r == '-' || r == '[' || r == ']'
+}
+
+type matchParser struct {
+	tokens []matchToken
+	pos    int
+}
+
+func (p *matchParser) peekOp(op string) bool {
+	return p.pos < len(p.tokens) &&
+		p.tokens[p.pos].kind == tokOp &&
+		p.tokens[p.pos].val == op
+}
+
+func (p *matchParser) parseOr() (routeMatcher, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.peekOp("||") {
+		p.pos++
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		l := left
+		left = func(req routeRequest) bool { return l(req) || right(req) }
+	}
+	return left, nil
+}
+
+func (p *matchParser) parseAnd() (routeMatcher, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for p.peekOp("&&") {
+		p.pos++
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		l := left
+		left = func(req routeRequest) bool { return l(req) && right(req) }
+	}
+	return left, nil
+}
+
+func (p *matchParser) parseUnary() (routeMatcher, error) {
+	if p.pos >= len(p.tokens) {
+		return nil, fmt.Errorf("unexpected end of match expression")
+	}
+
+	switch {
+	case p.peekOp("!"):
+		p.pos++
+		m, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return func(req routeRequest) bool { return !m(req) }, nil
+	case p.peekOp("("):
+		p.pos++
+		m, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if !p.peekOp(")") {
+			return nil, fmt.Errorf("missing closing ')' in match expression")
+		}
+		p.pos++
+		return m, nil
+	}
+
+	tok := p.tokens[p.pos]
+	if tok.kind != tokField {
+		return nil, fmt.Errorf("expected field, got %q in match expression", tok.val)
+	}
+	p.pos++
+	values, err := routeField(tok.val)
+	if err != nil {
+		return nil, err
+	}
+
+	// Field on its own, check it exists with a value
+	if p.pos >= len(p.tokens) || p.tokens[p.pos].kind != tokOp ||
+		!strings.ContainsAny(p.tokens[p.pos].val, "=~") {
+		return func(req routeRequest) bool {
+			for _, v := range values(req) {
+				if v != "" {
+					return true
+				}
+			}
+			return false
+		}, nil
+	}
+
+	op := p.tokens[p.pos].val
+	p.pos++
+	if p.pos >= len(p.tokens) || p.tokens[p.pos].kind != tokString {
+		return nil, fmt.Errorf("expected quoted string after %q in match expression", op)
+	}
+	want := p.tokens[p.pos].val
+	p.pos++
+
+	var cmp func(string) bool
+	switch op {
+	case "==", "!=":
+		cmp = func(v string) bool { return v == want }
+	default:
+		re, err := regexp.Compile("^(?:" + want + ")$")
+		if err != nil {
+			return nil, fmt.Errorf("invalid regex %q: %w", want, err)
+		}
+		cmp = re.MatchString
+	}
+	negate := op[0] == '!'
+
+	return func(req routeRequest) bool {
+		found := false
+		for _, v := range values(req) {
+			if cmp(v) {
+				found = true
+				break
+			}
+		}
+		return found != negate
+	}, nil
+}
+
+// Map a field name in a match expression to the request values it refers to.
+func routeField(name string) (func(req routeRequest) []string, error) {
+	switch {
+	case name == "path":
+		return func(req routeRequest) []string { return []string{req.Path} }, nil
+	case strings.HasPrefix(name, "query.") && len(name) > len("query."):
+		key := strings.TrimPrefix(name, "query.")
+		return func(req routeRequest) []string { return req.Query[key] }, nil
+	case strings.HasPrefix(name, "header.") && len(name) > len("header."):
+		key := http.CanonicalHeaderKey(strings.TrimPrefix(name, "header."))
+		return func(req routeRequest) []string { return req.Header.Values(key) }, nil
+	}
+	return nil, fmt.Errorf("unknown field %q in match expression", name)
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/insikl/prometheus-nats-ambassador/internal/models"
+)
+
+// Test route rule resolution, first match wins and default as the fallback
+func TestRouteResolve(t *testing.T) {
+	route, err := newExporterRoute(models.Subscription{
+		Topic: "io.prometheus.exporter.target1_example_com.9115",
+		Route: models.PubSubRoute{
+			Default: "http://localhost:9115/metrics",
+			Rules: []models.RouteRule{
+				{Match: `query.module == "icmp"`, Path: "http://localhost:9115/probe?module=icmp"},
+				{Match: `path == "/probe" && (query.module =~ "http_.*" || header.x-debug)`, Path: "http://localhost:9115/probe"},
+				{Match: `query.collect[] =~ "cpu|meminfo" && !query.debug`, Path: "http://localhost:9100/metrics"},
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		path   string
+		query  string
+		header http.Header
+		want   string
+	}{
+		{"", "module=icmp", nil, "http://localhost:9115/probe?module=icmp"},
+		{"/probe", "module=http_2xx", nil, "http://localhost:9115/probe"},
+		{"/probe", "module=tcp", http.Header{"X-Debug": {"1"}}, "http://localhost:9115/probe"},
+		{"/probe", "module=tcp", nil, "http://localhost:9115/metrics"},
+		{"", "collect[]=disk&collect[]=cpu", nil, "http://localhost:9100/metrics"},
+		{"", "collect[]=cpu&debug=1", nil, "http://localhost:9115/metrics"},
+		{"", "", nil, "http://localhost:9115/metrics"},
+	}
+	for _, tt := range tests {
+		q, _ := url.ParseQuery(tt.query)
+		got, err := route.resolve(routeRequest{Path: tt.path, Query: q, Header: tt.header})
+		if err != nil {
+			t.Errorf("resolve(%q, %q): %v", tt.path, tt.query, err)
+		}
+		if got != tt.want {
+			t.Errorf("resolve(%q, %q) = %q, want %q", tt.path, tt.query, got, tt.want)
+		}
+	}
+}
+
+// Test invalid match expressions are rejected when loading subscriptions
+func TestRouteMatchInvalid(t *testing.T) {
+	for _, expr := range []string{
+		``,
+		`query.module ==`,
+		`query.module == icmp`,
+		`method == "GET"`,
+		`(path == "/probe"`,
+		`query.module =~ "("`,
+		`path == "/probe" extra`,
+	} {
+		if _, err := compileRouteMatch(expr); err == nil {
+			t.Errorf("compileRouteMatch(%q) expected error", expr)
+		}
+	}
+}
+
+// Test wildcard topics fill in route templates from the message subject
+func TestRouteTemplate(t *testing.T) {
+	route, err := newExporterRoute(models.Subscription{
+		Topic: "io.prometheus.exporter.*.9100",
+		Route: models.PubSubRoute{
+			Default: `http://{{replace "_" "." (token 4)}}:{{token -1}}/metrics`,
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !route.wildcard() {
+		t.Errorf("expected wildcard topic")
+	}
+
+	got, err := route.resolve(routeRequest{Subject: "io.prometheus.exporter.host1_localnet.9100"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "http://host1.localnet:9100/metrics"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	if _, err := route.resolve(routeRequest{Subject: "short.9100"}); err == nil {
+		t.Errorf("expected error for missing token")
+	}
+
+	// Tokens can not take the request to another host
+	for _, subj := range []string{
+		"io.prometheus.exporter.evil_com/#.9100",
+		"io.prometheus.exporter.user@evil_com.9100",
+		"io.prometheus.exporter.evil_com?x=.9100",
+		"io.prometheus.exporter.evil_com%2f.9100",
+		"io.prometheus.exporter.host1.9100/x",
+	} {
+		if got, err := route.resolve(routeRequest{Subject: subj}); err == nil {
+			t.Errorf("expected error for %q, got %q", subj, got)
+		}
+	}
+
+	// Even a template that would let a value through keeps its host
+	loose, err := newRouteEndpoint(`http://{{replace "_" "/" (token 1)}}.localnet:9100/metrics`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := loose.render("evil_x.9100"); err == nil {
+		t.Errorf("expected error for escaping the host, got %q", got)
+	}
+	if got, err := loose.render("host1.9100"); err != nil || got != "http://host1.localnet:9100/metrics" {
+		t.Errorf("got %q, %v", got, err)
+	}
+
+	// Nor leave the directory of a file template
+	file, err := newRouteEndpoint(`file:///var/lib/textfile/{{replace "_" "." (token 2)}}/metrics.prom`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, subj := range []string{"files.__", "files.__.x"} {
+		if got, err := file.render(subj); err == nil {
+			t.Errorf("expected error for %q, got %q", subj, got)
+		}
+	}
+	if got, err := file.render("files.node_1"); err != nil || got != "file:///var/lib/textfile/node.1/metrics.prom" {
+		t.Errorf("got %q, %v", got, err)
+	}
+}
+
+// Test worker pool settings from subscription metadata
+func TestRouteWorkerMetadata(t *testing.T) {
+	route, err := newExporterRoute(models.Subscription{
+		Topic:    "io.prometheus.exporter.target1_example_com.9187",
+		Metadata: map[string]string{"concurrency": "8", "max_inflight": "2"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// In-flight limit can not be lower than the number of workers
+	if route.concurrency != 8 || route.maxInflight != 8 {
+		t.Errorf("got concurrency %d max_inflight %d", route.concurrency, route.maxInflight)
+	}
+
+	for _, md := range []map[string]string{
+		{"concurrency": "0"},
+		{"max_inflight": "lots"},
+	} {
+		if _, err := newExporterRoute(models.Subscription{Topic: "t", Metadata: md}); err == nil {
+			t.Errorf("expected error for %v", md)
+		}
+	}
+}
+
+// Test the queue group from `-queue` and the `queue` metadata key
+func TestRouteQueue(t *testing.T) {
+	defer func(q string) { queueGroup = q }(queueGroup)
+	queueGroup = "ambassadors"
+
+	tests := []struct {
+		metadata map[string]string
+		want     string
+	}{
+		{nil, "ambassadors"},
+		{map[string]string{"queue": "site1"}, "site1"},
+		// Empty turns the queue group off, every ambassador answers
+		{map[string]string{"queue": ""}, ""},
+	}
+	for _, tt := range tests {
+		route, err := newExporterRoute(models.Subscription{Topic: "t", Metadata: tt.metadata})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if route.queue != tt.want {
+			t.Errorf("metadata %v: got queue %q, want %q", tt.metadata, route.queue, tt.want)
+		}
+	}
+
+	queueGroup = ""
+	if route, _ := newExporterRoute(models.Subscription{Topic: "t"}); route.queue != "" {
+		t.Errorf("got queue %q without -queue", route.queue)
+	}
+}
+
+// Test health checks fail requests fast only for the checked endpoint
+func TestRouteHealth(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+
+	route, err := newExporterRoute(models.Subscription{
+		Topic: "io.prometheus.exporter.target1_example_com.9100",
+		Route: models.PubSubRoute{Default: "http://" + addr + "/metrics"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	route.health.check(route)
+	if err := route.health.failFast(route.def.raw); err != nil {
+		t.Errorf("expected up, got %v", err)
+	}
+
+	ln.Close()
+	route.health.check(route)
+	if err := route.health.failFast(route.def.raw); err == nil {
+		t.Errorf("expected down")
+	}
+	if err := route.health.failFast("http://other:9100/metrics"); err != nil {
+		t.Errorf("other endpoints are not failed: %v", err)
+	}
+
+	// Wildcard routes are not checked
+	wild, _ := newExporterRoute(models.Subscription{
+		Topic: "io.prometheus.exporter.*.9100",
+		Route: models.PubSubRoute{Default: "http://{{token 4}}:9100/metrics"},
+	})
+	if wild.health != nil {
+		t.Errorf("expected no health check for wildcard route")
+	}
+}
@@ -0,0 +1,252 @@
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/insikl/prometheus-nats-ambassador/internal/models"
+)
+
+// Besides http(s) a route can point at collectors that are not HTTP servers:
+//
+//	unix:///run/exporter.sock:/metrics    HTTP over a unix socket
+//	file:///var/lib/node_exporter/textfile  a `.prom` file or directory of them
+//	exec:///usr/local/bin/metrics.sh?arg=-v  output of a command
+//
+// Replies go back over NATS the same as from an HTTP exporter.
+const (
+	// Subscription metadata for `exec://` routes
+	metadataExecTimeout  = "exec_timeout"
+	metadataExecEnv      = "exec_env"
+	metadataExecMaxBytes = "exec_max_bytes"
+)
+
+// Content type of `file://` and `exec://` replies, text exposition format
+// https://prometheus.io/docs/instrumenting/exposition_formats/#text-based-format
+const textContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// Limits for `exec://` routes
+type execOptions struct {
+	// Upper bound on run time, the scrape timeout applies when it is shorter
+	timeout time.Duration
+	// Extra `KEY=value` pairs, commands otherwise only get `PATH` and
+	// `QUERY_STRING`
+	env []string
+	// Output past this is an error
+	maxBytes int64
+}
+
+var defaultExecOptions = execOptions{
+	timeout:  30 * time.Second,
+	maxBytes: 16 << 20,
+}
+
+// Build the exec limits from subscription metadata
+func newExecOptions(sub models.Subscription) (execOptions, error) {
+	opts := defaultExecOptions
+	md := sub.Metadata
+	if v, ok := md[metadataExecTimeout]; ok {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			return opts, fmt.Errorf("metadata %v: invalid duration %q", metadataExecTimeout, v)
+		}
+		opts.timeout = d
+	}
+	if v, ok := md[metadataExecMaxBytes]; ok {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n <= 0 {
+			return opts, fmt.Errorf("metadata %v: invalid size %q", metadataExecMaxBytes, v)
+		}
+		opts.maxBytes = n
+	}
+	if v, ok := md[metadataExecEnv]; ok {
+		for _, kv := range strings.Split(v, ",") {
+			kv = strings.TrimSpace(kv)
+			if kv == "" {
+				continue
+			}
+			if !strings.Contains(kv, "=") {
+				return opts, fmt.Errorf("metadata %v: expected KEY=value, got %q", metadataExecEnv, kv)
+			}
+			opts.env = append(opts.env, kv)
+		}
+	}
+	return opts, nil
+}
+
+// Split `unix:///run/exporter.sock:/metrics` into the socket and the HTTP URL
+// to request over it, the path defaults to `/metrics`.
+func unixSocketURL(u *url.URL) (string, string) {
+	sock, path, ok := strings.Cut(u.Path, ":")
+	if !ok || path == "" {
+		path = "/metrics"
+	}
+	target := "http://localhost" + path
+	if u.RawQuery != "" {
+		target += "?" + u.RawQuery
+	}
+	return sock, target
+}
+
+// Transports per unix socket so connections are reused between scrapes
+var unixTransports sync.Map
+
+func unixTransport(sock string) *http.Transport {
+	if t, ok := unixTransports.Load(sock); ok {
+		return t.(*http.Transport)
+	}
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.DialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+		var d net.Dialer
+		return d.DialContext(ctx, "unix", sock)
+	}
+	actual, _ := unixTransports.LoadOrStore(sock, t)
+	return actual.(*http.Transport)
+}
+
+// Successful reply from a local source, counted the same as an HTTP one
+func localReply(topic string, body []byte) (*exporterReply, error) {
+	proxyReply.With(prometheus.Labels{
+		"subject": topic,
+		"code":    strconv.Itoa(http.StatusOK),
+	}).Inc()
+
+	hdr := http.Header{}
+	hdr.Set("Content-Type", textContentType)
+	return &exporterReply{
+		Status: http.StatusOK,
+		Header: hdr,
+		Body:   body,
+	}, nil
+}
+
+// Read a `.prom` file, or every `*.prom` file in a directory in name order
+// like the node_exporter textfile collector.
+// https://github.com/prometheus/node_exporter#textfile-collector
+func fileRequest(topic string, u *url.URL) (*exporterReply, error) {
+	fi, err := os.Stat(u.Path)
+	if err != nil {
+		return errorReply(topic, http.StatusBadGateway, err)
+	}
+	if !fi.IsDir() {
+		body, err := os.ReadFile(u.Path)
+		if err != nil {
+			return errorReply(topic, http.StatusBadGateway, err)
+		}
+		return localReply(topic, body)
+	}
+
+	files, err := filepath.Glob(filepath.Join(u.Path, "*.prom"))
+	if err != nil {
+		return errorReply(topic, http.StatusInternalServerError, err)
+	}
+	sort.Strings(files)
+
+	var body bytes.Buffer
+	for _, file := range files {
+		b, err := os.ReadFile(file)
+		if err != nil {
+			return errorReply(topic, http.StatusBadGateway, err)
+		}
+		body.Write(b)
+		if len(b) > 0 && b[len(b)-1] != '\n' {
+			body.WriteByte('\n')
+		}
+	}
+	return localReply(topic, body.Bytes())
+}
+
+// Writer that fails once more than `max` bytes are written, or drops the rest
+// quietly with `truncate`. Not an embedded `bytes.Buffer` as its `ReadFrom`
+// would skip the limit.
+type limitedBuffer struct {
+	buf      bytes.Buffer
+	max      int64
+	truncate bool
+}
+
+var errOutputTooLarge = errors.New("output too large")
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	if int64(b.buf.Len()+len(p)) > b.max {
+		if b.truncate {
+			b.buf.Write(p[:max(b.max-int64(b.buf.Len()), 0)])
+			return len(p), nil
+		}
+		return 0, errOutputTooLarge
+	}
+	return b.buf.Write(p)
+}
+
+// Run the command of an `exec://` route and reply with its output. Arguments
+// come from `arg` params on the route URL, scrape params are passed CGI style
+// in `QUERY_STRING` and never on the command line.
+func execRequest(
+	topic string,
+	u *url.URL,
+	params url.Values,
+	timeout time.Duration,
+	opts execOptions,
+) (*exporterReply, error) {
+	if !filepath.IsAbs(u.Path) {
+		return errorReply(topic, http.StatusInternalServerError,
+			fmt.Errorf("command %q must be an absolute path", u.Path))
+	}
+	if opts.timeout < timeout {
+		timeout = opts.timeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, u.Path, u.Query()["arg"]...)
+	cmd.Env = append([]string{
+		"PATH=/usr/local/bin:/usr/bin:/bin",
+		"QUERY_STRING=" + params.Encode(),
+	}, opts.env...)
+	cmd.Dir = filepath.Dir(u.Path)
+	cmd.WaitDelay = time.Second
+
+	stdout := &limitedBuffer{max: opts.maxBytes}
+	stderr := &limitedBuffer{max: 4096, truncate: true}
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+
+	if err := cmd.Run(); err != nil {
+		if ctx.Err() != nil {
+			return errorReply(topic, http.StatusGatewayTimeout,
+				fmt.Errorf("command %v timed out after %v", u.Path, timeout))
+		}
+		if msg := strings.TrimSpace(stderr.buf.String()); msg != "" {
+			err = fmt.Errorf("%w: %v", err, msg)
+		}
+		return errorReply(topic, http.StatusBadGateway,
+			fmt.Errorf("command %v failed: %w", u.Path, err))
+	}
+	return localReply(topic, stdout.buf.Bytes())
+}
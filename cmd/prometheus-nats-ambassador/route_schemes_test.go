@@ -0,0 +1,60 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/insikl/prometheus-nats-ambassador/internal/models"
+)
+
+// Test `file://` directories and `exec://` commands reply like an exporter
+func TestRouteSchemes(t *testing.T) {
+	dir := t.TempDir()
+	for name, data := range map[string]string{
+		"b.prom":   "b 2\n",
+		"a.prom":   "a 1",
+		"skip.txt": "c 3\n",
+	} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(data), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	reply, err := ProxyPrometheusRequest("test", "file://"+dir, "", http.Header{}, nil)
+	if err != nil || string(reply.Body) != "a 1\nb 2\n" {
+		t.Errorf("file: got %q, %v", reply.Body, err)
+	}
+
+	sh := "/bin/sh"
+	if _, err := os.Stat(sh); err != nil {
+		t.Skip("no /bin/sh")
+	}
+	route, err := newExporterRoute(models.Subscription{
+		Topic:    "test",
+		Metadata: map[string]string{"exec_env": "SITE=dc1", "exec_max_bytes": "64"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	script := `echo "up{site=\"$SITE\",q=\"$QUERY_STRING\"} 1"`
+	reply, err = ProxyPrometheusRequest("test",
+		"exec://"+sh+"?arg=-c&arg="+strings.ReplaceAll(script, " ", "+"),
+		"module=x", http.Header{}, route)
+	if want := "up{site=\"dc1\",q=\"module=x\"} 1\n"; err != nil || string(reply.Body) != want {
+		t.Errorf("exec: got %q, %v", reply.Body, err)
+	}
+
+	// Output over `exec_max_bytes` and failing commands are errors
+	for _, script := range []string{"yes | head -c 1000", "exit 3"} {
+		reply, err = ProxyPrometheusRequest("test",
+			"exec://"+sh+"?arg=-c&arg="+strings.ReplaceAll(script, " ", "+"),
+			"", http.Header{}, route)
+		if err == nil || reply.Status != http.StatusBadGateway {
+			t.Errorf("%q: expected 502, got %v %v", script, reply.Status, err)
+		}
+	}
+}
@@ -0,0 +1,222 @@
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"text/template"
+)
+
+// Subject formats `-subjfmt` can be set to by name, anything else is parsed as
+// a Go template.
+// https://pkg.go.dev/text/template
+var subjectPresets = map[string]string{
+	"mod": "{{.Base}}{{.HostJoined}}.{{.Port}}",
+	"fwd": "{{.Base}}{{.HostFwd}}.{{.Port}}",
+	"rev": "{{.Base}}{{.HostRev}}.{{.Port}}",
+}
+
+// Exporter names for `{{.Exporter}}` by port, from the Prometheus default
+// port allocations. Extended or overridden with `-portmap`.
+// https://github.com/prometheus/prometheus/wiki/Default-port-allocations
+var exporterPorts = map[string]string{
+	"9090": "prometheus",
+	"9091": "pushgateway",
+	"9093": "alertmanager",
+	"9100": "node",
+	"9101": "haproxy",
+	"9104": "mysqld",
+	"9113": "nginx",
+	"9115": "blackbox",
+	"9116": "snmp",
+	"9117": "apache",
+	"9121": "redis",
+	"9150": "memcached",
+	"9182": "windows",
+	"9187": "postgres",
+	"9216": "mongodb",
+	"9256": "process",
+	"9308": "kafka",
+	"9419": "rabbitmq",
+}
+
+var (
+	// Compiled `-subjfmt`
+	subjectTemplate = template.Must(template.New("subject").Parse(subjectPresets[topicFmt]))
+	// Exact subjects for specific `host:port` targets, from `-subjmap`
+	subjectOverrides = make(map[string]string)
+)
+
+// Values available to the subject template. Example for a scrape of
+// `target1.example.com:9100?site=dc1`:
+//
+//	{{.Base}}        io.prometheus.exporter.
+//	{{.Host}}        target1.example.com
+//	{{.HostFwd}}     target1.example.com
+//	{{.HostRev}}     com.example.target1
+//	{{.HostJoined}}  target1_example_com
+//	{{.Tokens}}      [target1 example com], use {{index .Tokens 0}}
+//	{{.Port}}        9100
+//	{{.Exporter}}    node (port when not in the port map)
+//	{{.Param "site"}} dc1
+type subjectData struct {
+	Base       string
+	Host       string
+	HostFwd    string
+	HostRev    string
+	HostJoined string
+	Tokens     []string
+	Port       string
+	Exporter   string
+
+	params url.Values
+}
+
+// Query param from the scrape request. Has to fit in one subject token,
+// otherwise whoever shapes the scrape URL could pick any subject.
+func (d subjectData) Param(name string) (string, error) {
+	v := d.params.Get(name)
+	if v != "" && !routeTokenRegexp.MatchString(v) {
+		return "", fmt.Errorf("param %v=%q is not a valid subject token", name, v)
+	}
+	return v, nil
+}
+
+// Parse `-subjfmt` as a preset name or template
+func parseSubjectFormat(format string) (*template.Template, error) {
+	if preset, ok := subjectPresets[format]; ok {
+		format = preset
+	}
+	return template.New("subject").Option("missingkey=error").Parse(format)
+}
+
+// Load a JSON file of `"host:port": "port"` or `"host:port": "subject"` pairs
+func loadStringMap(file string) (map[string]string, error) {
+	byteValue, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	m := make(map[string]string)
+	if err := json.Unmarshal(byteValue, &m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// Load `-subjmap`, targets are lowercased to match the resolved target
+func loadSubjectOverrides(file string) (map[string]string, error) {
+	m, err := loadStringMap(file)
+	if err != nil {
+		return nil, err
+	}
+	overrides := make(map[string]string, len(m))
+	for target, subj := range m {
+		key := strings.ToLower(target)
+		if prev, ok := overrides[key]; ok && prev != subj {
+			return nil, fmt.Errorf("%q mapped to both %q and %q", key, prev, subj)
+		}
+		overrides[key] = subj
+	}
+	return overrides, nil
+}
+
+// Build the NATS subject to send requests to from the target host and port,
+// an exact match in the override file wins over the subject template.
+func hostSubject(hostName, hostPort string, params url.Values) (string, error) {
+	if subj, ok := subjectOverrides[net.JoinHostPort(hostName, hostPort)]; ok {
+		return subj, nil
+	}
+
+	// Normalize hostname, create array of hostname in forward and reverse.
+	hostFwd := strings.Split(hostName, ".")
+
+	// Reverse hostname
+	var hostRev []string
+	for _, n := range hostFwd {
+		hostRev = append([]string{n}, hostRev...)
+	}
+
+	exporter, ok := exporterPorts[hostPort]
+	if !ok {
+		exporter = hostPort
+	}
+
+	var subj strings.Builder
+	err := subjectTemplate.Execute(&subj, subjectData{
+		Base:       topicBase,
+		Host:       hostName,
+		HostFwd:    strings.Join(hostFwd, "."),
+		HostRev:    strings.Join(hostRev, "."),
+		HostJoined: strings.ReplaceAll(hostName, ".", "_"),
+		Tokens:     hostFwd,
+		Port:       hostPort,
+		Exporter:   exporter,
+		params:     params,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	// Template output has to be a usable subject, no empty tokens or wildcards
+	// https://github.com/nats-io/nats-architecture-and-design/blob/main/adr/ADR-6.md
+	s := subj.String()
+	for _, token := range strings.Split(s, ".") {
+		if token == "" || token == "*" || token == ">" || strings.ContainsAny(token, " \t\r\n") {
+			return "", fmt.Errorf("invalid subject %q for %v:%v", s, hostName, hostPort)
+		}
+	}
+	return s, nil
+}
+
+// Map a subject back to the `host:port` Prometheus would scrape, reverse of
+// `hostSubject`. Only possible for the override file and the named presets,
+// returns false otherwise.
+func subjectTarget(subj string) (string, bool) {
+	for target, s := range subjectOverrides {
+		if s == subj {
+			return target, true
+		}
+	}
+	if _, ok := subjectPresets[topicFmt]; !ok {
+		return "", false
+	}
+
+	rest, ok := strings.CutPrefix(subj, topicBase)
+	if !ok || rest == "" {
+		return "", false
+	}
+	tokens := strings.Split(rest, ".")
+	if len(tokens) < 2 {
+		return "", false
+	}
+	port := tokens[len(tokens)-1]
+	host := tokens[:len(tokens)-1]
+
+	switch topicFmt {
+	case "rev":
+		for i, j := 0, len(host)-1; i < j; i, j = i+1, j-1 {
+			host[i], host[j] = host[j], host[i]
+		}
+	case "fwd":
+	default:
+		if len(host) != 1 {
+			return "", false
+		}
+		host[0] = strings.ReplaceAll(host[0], "_", ".")
+	}
+	return net.JoinHostPort(strings.Join(host, "."), port), true
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Test subject presets, templates and overrides map back and forth
+func TestHostSubject(t *testing.T) {
+	defer func(f string) {
+		topicFmt = f
+		subjectTemplate, _ = parseSubjectFormat(f)
+		subjectOverrides = map[string]string{}
+	}(topicFmt)
+
+	subjectOverrides = map[string]string{
+		"legacy.example.com:9100": "metrics.legacy.node",
+	}
+	params := url.Values{"site": {"dc1"}}
+
+	tests := []struct {
+		format string
+		host   string
+		port   string
+		want   string
+	}{
+		{"mod", "target1.example.com", "9100", "io.prometheus.exporter.target1_example_com.9100"},
+		{"fwd", "target1.example.com", "9100", "io.prometheus.exporter.target1.example.com.9100"},
+		{"rev", "target1.example.com", "9100", "io.prometheus.exporter.com.example.target1.9100"},
+		{`metrics.{{.Param "site"}}.{{.HostJoined}}.{{.Exporter}}`, "target1.example.com", "9100", "metrics.dc1.target1_example_com.node"},
+		{`metrics.{{index .Tokens 0}}.{{.Exporter}}`, "target1.example.com", "9999", "metrics.target1.9999"},
+		{"mod", "legacy.example.com", "9100", "metrics.legacy.node"},
+	}
+	for _, tt := range tests {
+		tmpl, err := parseSubjectFormat(tt.format)
+		if err != nil {
+			t.Fatalf("%q: %v", tt.format, err)
+		}
+		topicFmt, subjectTemplate = tt.format, tmpl
+
+		got, err := hostSubject(tt.host, tt.port, params)
+		if err != nil {
+			t.Errorf("%q: %v", tt.format, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("%q: got %q, want %q", tt.format, got, tt.want)
+		}
+
+		// Presets and overrides can be mapped back for service discovery
+		if _, ok := subjectPresets[tt.format]; ok {
+			if target, ok := subjectTarget(got); !ok || target != tt.host+":"+tt.port {
+				t.Errorf("%q: subjectTarget(%q) = %q, %v", tt.format, got, target, ok)
+			}
+		}
+	}
+
+	// Missing params leave an empty token which is not a valid subject
+	subjectTemplate, _ = parseSubjectFormat(`metrics.{{.Param "site"}}.{{.Port}}`)
+	if got, err := hostSubject("target1", "9100", url.Values{}); err == nil {
+		t.Errorf("expected error for empty token, got %q", got)
+	}
+
+	// Params can not add tokens or wildcards
+	for _, site := range []string{"x.io.prometheus.exporter.other_host", "*", ">", "dc 1", "dc1\r\n"} {
+		if got, err := hostSubject("target1", "9100", url.Values{"site": {site}}); err == nil {
+			t.Errorf("expected error for site %q, got %q", site, got)
+		}
+	}
+}
+
+// Test `-subjmap` targets match whatever case they were written in
+func TestLoadSubjectOverrides(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "subjmap.json")
+	if err := os.WriteFile(file, []byte(`{"Legacy.Example.COM:9100": "metrics.legacy.node"}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	overrides, err := loadSubjectOverrides(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := overrides["legacy.example.com:9100"]; got != "metrics.legacy.node" {
+		t.Errorf("got %q from %v", got, overrides)
+	}
+
+	if err := os.WriteFile(file, []byte(`{"a.example.com:9100": "one", "A.example.com:9100": "two"}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadSubjectOverrides(file); err == nil {
+		t.Errorf("expected error for conflicting entries")
+	}
+}
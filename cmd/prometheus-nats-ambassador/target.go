@@ -0,0 +1,205 @@
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Where the target `host:port` of a scrape can come from, checked in the order
+// set by `-targetorder`. The first source that is set wins, a source that is
+// set but invalid fails the scrape instead of falling through.
+const (
+	// Explicit query param, name set by `-targetparam`
+	targetSourceParam = "param"
+	// RFC 7239 `Forwarded: host=...;proto=...`
+	targetSourceForwarded = "forwarded"
+	// `X-Forwarded-Host` and `X-Forwarded-Proto`
+	targetSourceXForwarded = "xforwarded"
+	// Absolute request URI, what Prometheus sends when using `proxy_url`
+	targetSourceURI = "uri"
+	// `Host` header
+	targetSourceHost = "host"
+)
+
+var (
+	targetOrder = []string{
+		targetSourceParam,
+		targetSourceForwarded,
+		targetSourceXForwarded,
+		targetSourceURI,
+		targetSourceHost,
+	}
+	targetParam = "ambassador"
+)
+
+// Default port per scheme when the target does not have one
+var schemeDefaultPorts = map[string]string{
+	"http":  "80",
+	"https": "443",
+}
+
+var errNoTarget = errors.New("unable to resolve target host from request")
+
+// Parse and check a `-targetorder` list
+func parseTargetOrder(order string) ([]string, error) {
+	var sources []string
+	for _, s := range strings.Split(order, ",") {
+		s = strings.ToLower(strings.TrimSpace(s))
+		switch s {
+		case targetSourceParam, targetSourceForwarded, targetSourceXForwarded,
+			targetSourceURI, targetSourceHost:
+			sources = append(sources, s)
+		case "":
+		default:
+			return nil, fmt.Errorf("unknown target source %q", s)
+		}
+	}
+	if len(sources) == 0 {
+		return nil, errors.New("empty target order")
+	}
+	return sources, nil
+}
+
+// Work out the target `host` and `port` for a request from the sources in
+// `targetOrder`. Any error should be returned to the scraper as a 400.
+func resolveTarget(r *http.Request) (string, string, error) {
+	for _, source := range targetOrder {
+		var value, scheme string
+
+		switch source {
+		case targetSourceParam:
+			value = r.URL.Query().Get(targetParam)
+		case targetSourceForwarded:
+			value, scheme = parseForwarded(r.Header.Get("Forwarded"))
+		case targetSourceXForwarded:
+			// Only the first entry, set by the proxy closest to Prometheus
+			value, _, _ = strings.Cut(r.Header.Get("X-Forwarded-Host"), ",")
+			scheme, _, _ = strings.Cut(r.Header.Get("X-Forwarded-Proto"), ",")
+		case targetSourceURI:
+			if r.URL.IsAbs() {
+				value, scheme = r.URL.Host, r.URL.Scheme
+			}
+		case targetSourceHost:
+			value, scheme = r.Host, "http"
+			if r.TLS != nil {
+				scheme = "https"
+			}
+		}
+
+		value = strings.TrimSpace(value)
+		if value == "" {
+			continue
+		}
+		host, port, err := splitTarget(value, strings.TrimSpace(scheme))
+		if err != nil {
+			return "", "", fmt.Errorf("invalid target from %v: %w", source, err)
+		}
+		return host, port, nil
+	}
+	return "", "", errNoTarget
+}
+
+// Get `host` and `proto` from the first element of a RFC 7239 `Forwarded`
+// header.
+// https://www.rfc-editor.org/rfc/rfc7239#section-4
+func parseForwarded(header string) (host string, proto string) {
+	first, _, _ := strings.Cut(header, ",")
+	for _, pair := range strings.Split(first, ";") {
+		k, v, ok := strings.Cut(strings.TrimSpace(pair), "=")
+		if !ok {
+			continue
+		}
+		if unquoted, err := strconv.Unquote(v); err == nil {
+			v = unquoted
+		}
+		switch strings.ToLower(k) {
+		case "host":
+			host = v
+		case "proto":
+			proto = v
+		}
+	}
+	return host, proto
+}
+
+// RFC 1123 hostname label
+var hostLabelRegexp = regexp.MustCompile(`^[a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?$`)
+
+// Check a host is an IP literal or a RFC 1123 hostname
+// https://www.rfc-editor.org/rfc/rfc1123#section-2
+func validHost(host string) bool {
+	if net.ParseIP(host) != nil {
+		return true
+	}
+	host = strings.TrimSuffix(host, ".")
+	if host == "" || len(host) > 253 {
+		return false
+	}
+	for _, label := range strings.Split(host, ".") {
+		if !hostLabelRegexp.MatchString(label) {
+			return false
+		}
+	}
+	return true
+}
+
+// Split a target in to normalized `host` and `port`, value can be `host`,
+// `host:port` or a URL. Missing ports use the scheme default port.
+func splitTarget(value, scheme string) (string, string, error) {
+	value = strings.ToLower(value)
+	if strings.Contains(value, "://") {
+		u, err := url.Parse(value)
+		if err != nil {
+			return "", "", err
+		}
+		value, scheme = u.Host, u.Scheme
+	}
+
+	host, port, err := net.SplitHostPort(value)
+	if err != nil {
+		var addrErr *net.AddrError
+		if !errors.As(err, &addrErr) || addrErr.Err != "missing port in address" {
+			return "", "", err
+		}
+		// No port, default it from the scheme
+		host = strings.TrimSuffix(strings.TrimPrefix(value, "["), "]")
+		if scheme == "" {
+			scheme = "http"
+		}
+		var ok bool
+		if port, ok = schemeDefaultPorts[strings.ToLower(scheme)]; !ok {
+			return "", "", fmt.Errorf("no port in %q and no default for scheme %q", value, scheme)
+		}
+	}
+
+	if host == "" {
+		return "", "", fmt.Errorf("empty host in %q", value)
+	}
+	// The host ends up in the NATS subject and from there in route templates,
+	// anything else than an IP or a hostname is refused
+	// https://github.com/nats-io/nats-architecture-and-design/blob/main/adr/ADR-6.md
+	if !validHost(host) {
+		return "", "", fmt.Errorf("invalid host %q", host)
+	}
+	if n, err := strconv.Atoi(port); err != nil || n < 1 || n > 65535 {
+		return "", "", fmt.Errorf("invalid port %q", port)
+	}
+	return host, port, nil
+}
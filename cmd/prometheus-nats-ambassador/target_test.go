@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bufio"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// Test target resolution precedence and default ports
+func TestResolveTarget(t *testing.T) {
+	tests := []struct {
+		name    string
+		request string
+		host    string
+		port    string
+		wantErr bool
+	}{
+		{
+			name:    "host header",
+			request: "GET /proxy HTTP/1.1\r\nHost: Target1.Example.com:9100\r\n\r\n",
+			host:    "target1.example.com",
+			port:    "9100",
+		},
+		{
+			name:    "host without port",
+			request: "GET /proxy HTTP/1.1\r\nHost: target1.example.com\r\n\r\n",
+			host:    "target1.example.com",
+			port:    "80",
+		},
+		{
+			name:    "absolute uri",
+			request: "GET https://target2.example.com/proxy HTTP/1.1\r\nHost: target2.example.com\r\n\r\n",
+			host:    "target2.example.com",
+			port:    "443",
+		},
+		{
+			name:    "x-forwarded-host",
+			request: "GET /proxy HTTP/1.1\r\nHost: localhost:8181\r\nX-Forwarded-Host: target3.example.com:9187, proxy1\r\n\r\n",
+			host:    "target3.example.com",
+			port:    "9187",
+		},
+		{
+			name:    "forwarded before x-forwarded-host",
+			request: "GET /proxy HTTP/1.1\r\nHost: localhost:8181\r\nForwarded: for=10.0.0.1;host=\"target4.example.com\";proto=https\r\nX-Forwarded-Host: target3.example.com\r\n\r\n",
+			host:    "target4.example.com",
+			port:    "443",
+		},
+		{
+			name:    "param first",
+			request: "GET /proxy?ambassador=[fd00::1]:9100 HTTP/1.1\r\nHost: target1.example.com:9100\r\n\r\n",
+			host:    "fd00::1",
+			port:    "9100",
+		},
+		{
+			name:    "invalid port",
+			request: "GET /proxy HTTP/1.1\r\nHost: target1.example.com:99999\r\n\r\n",
+			wantErr: true,
+		},
+		{
+			name:    "invalid subject characters",
+			request: "GET /proxy?ambassador=*:9100 HTTP/1.1\r\nHost: target1.example.com\r\n\r\n",
+			wantErr: true,
+		},
+		{
+			name:    "url delimiters in param",
+			request: "GET /proxy?ambassador=evil.com/%23:9100 HTTP/1.1\r\nHost: target1.example.com\r\n\r\n",
+			wantErr: true,
+		},
+		{
+			name:    "userinfo in forwarded",
+			request: "GET /proxy HTTP/1.1\r\nHost: localhost:8181\r\nForwarded: host=\"user@evil.com:9100\"\r\n\r\n",
+			wantErr: true,
+		},
+		{
+			name:    "percent in x-forwarded-host",
+			request: "GET /proxy HTTP/1.1\r\nHost: localhost:8181\r\nX-Forwarded-Host: evil.com%2f:9100\r\n\r\n",
+			wantErr: true,
+		},
+		{
+			name:    "query in x-forwarded-host",
+			request: "GET /proxy HTTP/1.1\r\nHost: localhost:8181\r\nX-Forwarded-Host: evil.com?x:9100\r\n\r\n",
+			wantErr: true,
+		},
+		{
+			name:    "label starting with dash",
+			request: "GET /proxy?ambassador=-bad.example.com:9100 HTTP/1.1\r\nHost: target1.example.com\r\n\r\n",
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		r, err := http.ReadRequest(bufio.NewReader(strings.NewReader(tt.request)))
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		host, port, err := resolveTarget(r)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("%s: expected error, got %s:%s", tt.name, host, port)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if host != tt.host || port != tt.port {
+			t.Errorf("%s: got %s:%s, want %s:%s", tt.name, host, port, tt.host, tt.port)
+		}
+	}
+}
@@ -0,0 +1,102 @@
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/nats-io/nats.go"
+
+	"github.com/insikl/prometheus-nats-ambassador/internal/logger"
+)
+
+// NATS calls a subscription handler one message at a time, so one slow scrape
+// holds up every other request on the subject. Messages are handed off to a
+// pool of workers per subscription instead, anything over the in-flight limit
+// is answered with a 503 right away rather than left to time out.
+// https://pkg.go.dev/github.com/nats-io/nats.go#hdr-Subscriptions
+var (
+	// Workers per subscription, metadata `concurrency` overrides
+	routeConcurrency = 4
+	// Requests being handled or waiting for a worker per subscription before
+	// new ones are dropped, metadata `max_inflight` overrides
+	routeMaxInflight = 64
+
+	// NATS pending limits for subscriptions, messages not yet handed to the
+	// workers. Past these NATS drops messages and reports a slow consumer.
+	pendingMsgsLimit  = nats.DefaultSubPendingMsgsLimit
+	pendingBytesLimit = nats.DefaultSubPendingBytesLimit
+)
+
+// Subscription metadata keys for the worker pool
+const (
+	metadataConcurrency = "concurrency"
+	metadataMaxInflight = "max_inflight"
+)
+
+var errMaxInflight = errors.New("too many requests in flight")
+
+type routeWorkers struct {
+	topic string
+	jobs  chan *nats.Msg
+}
+
+// Start the workers for a subscription handling messages with `handle`,
+// returns the handler to subscribe with
+func (pubsub *ProxyConn) startWorkers(topic string, concurrency, maxInflight int, handle nats.MsgHandler) nats.MsgHandler {
+	w := &routeWorkers{
+		topic: topic,
+		jobs:  make(chan *nats.Msg, maxInflight-concurrency),
+	}
+	for i := 0; i < concurrency; i++ {
+		go func() {
+			for msg := range w.jobs {
+				subscriptionQueueDepth.WithLabelValues(w.topic).Dec()
+				handle(msg)
+			}
+		}()
+	}
+
+	return func(msg *nats.Msg) {
+		subscriptionQueueDepth.WithLabelValues(w.topic).Inc()
+		select {
+		case w.jobs <- msg:
+		default:
+			subscriptionQueueDepth.WithLabelValues(w.topic).Dec()
+			subscriptionDropped.WithLabelValues(w.topic).Inc()
+			err := fmt.Errorf("%w on [%v], limit %d", errMaxInflight, w.topic, maxInflight)
+			logger.Warn("%v", err)
+			reply, _ := errorReply(msg.Subject, http.StatusServiceUnavailable, err)
+			pubsub.RespondReply(msg, newReplyMsg(reply, err))
+		}
+	}
+}
+
+// NATS async error handler, counts slow consumer events per subscription
+func natsErrorHandler(nc *nats.Conn, sub *nats.Subscription, err error) {
+	subject := ""
+	if sub != nil {
+		subject = sub.Subject
+	}
+	if errors.Is(err, nats.ErrSlowConsumer) {
+		natsSlowConsumer.WithLabelValues(subject).Inc()
+		if sub != nil {
+			if dropped, derr := sub.Dropped(); derr == nil {
+				logger.Warn("Slow consumer on [%v], %d messages dropped", subject, dropped)
+				return
+			}
+		}
+	}
+	logger.Error("NATS error on [%v]: %v", subject, err)
+}
@@ -0,0 +1,32 @@
+package models
+
+import "time"
+
+// Struct to represent what an exporter side ambassador replies with on the
+// discovery subject and publishes as a heartbeat, lists the topics it serves.
+// Heartbeats set `Expires`, once passed without a newer heartbeat the
+// ambassador should be considered gone.
+type Announcement struct {
+	Hostname      string           `json:"hostname"`
+	Instance      string           `json:"instance,omitempty"`
+	Version       string           `json:"version"`
+	Timestamp     time.Time        `json:"timestamp"`
+	Interval      float64          `json:"interval_seconds,omitempty"`
+	Expires       time.Time        `json:"expires,omitzero"`
+	Subscriptions []AnnouncedTopic `json:"subscriptions"`
+}
+
+// Subscription details shared with discovery, the route is left out as it is
+// only meaningful to the exporter side.
+type AnnouncedTopic struct {
+	PubSubName string            `json:"pubsubname"`
+	Topic      string            `json:"topic"`
+	Metadata   map[string]string `json:"metadata,omitempty"`
+}
+
+// Prometheus HTTP service discovery target group
+// https://prometheus.io/docs/prometheus/latest/http_sd/
+type TargetGroup struct {
+	Targets []string          `json:"targets"`
+	Labels  map[string]string `json:"labels,omitempty"`
+}
@@ -0,0 +1,10 @@
+package models
+
+// Struct to represent an entry in the `/probe` mapping table JSON, picks the
+// ambassador that owns a multi-target exporter (blackbox, snmp) when the
+// scrape does not set one. `Target` and `Module` are regex, empty matches all.
+type ProbeMapping struct {
+	Target     string `json:"target,omitempty"`
+	Module     string `json:"module,omitempty"`
+	Ambassador string `json:"ambassador"`
+}
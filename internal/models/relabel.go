@@ -0,0 +1,14 @@
+package models
+
+// Struct to represent a Prometheus `metric_relabel_configs` entry in JSON,
+// applied on the exporter side before replying over NATS. Unset fields take
+// the Prometheus defaults.
+// https://prometheus.io/docs/prometheus/latest/configuration/configuration/#relabel_config
+type RelabelConfig struct {
+	SourceLabels []string `json:"source_labels,omitempty"`
+	Separator    *string  `json:"separator,omitempty"`
+	Regex        *string  `json:"regex,omitempty"`
+	TargetLabel  string   `json:"target_label,omitempty"`
+	Replacement  *string  `json:"replacement,omitempty"`
+	Action       string   `json:"action,omitempty"`
+}
@@ -6,6 +6,10 @@ type Subscription struct {
 	Topic      string            `json:"topic"`
 	Metadata   map[string]string `json:"metadata,omitempty"`
 	Route      PubSubRoute       `json:"route"`
+
+	// Applied to the exporter reply before it is sent over NATS
+	MetricRelabelConfigs []RelabelConfig   `json:"metric_relabel_configs,omitempty"`
+	StaticLabels         map[string]string `json:"static_labels,omitempty"`
 }
 
 type PubSubRoute struct {
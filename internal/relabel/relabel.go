@@ -0,0 +1,177 @@
+// Minimal Prometheus style relabeling for metric labels, supports the actions
+// replace, keep, drop, labeldrop and labelkeep.
+// https://prometheus.io/docs/prometheus/latest/configuration/configuration/#relabel_config
+package relabel
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/insikl/prometheus-nats-ambassador/internal/models"
+)
+
+// Action to take on a label set
+type Action string
+
+const (
+	Replace   Action = "replace"
+	Keep      Action = "keep"
+	Drop      Action = "drop"
+	LabelDrop Action = "labeldrop"
+	LabelKeep Action = "labelkeep"
+)
+
+// Label holding the metric name
+const MetricName = "__name__"
+
+var (
+	// Label and metric names that can be written in the text format
+	labelNameRegexp  = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+	metricNameRegexp = regexp.MustCompile(`^[a-zA-Z_:][a-zA-Z0-9_:]*$`)
+
+	// Target labels can hold `$1` or `${name}` references to regex groups,
+	// same as in Prometheus
+	targetLabelRegexp = regexp.MustCompile(`^(?:(?:[a-zA-Z_]|\$(?:\{\w+\}|\w+))+\w*)+$`)
+)
+
+// Check a label name is valid
+func ValidLabelName(name string) bool {
+	return labelNameRegexp.MatchString(name)
+}
+
+// Check a metric name is valid
+func ValidMetricName(name string) bool {
+	return metricNameRegexp.MatchString(name)
+}
+
+// Compiled relabel config
+type Config struct {
+	SourceLabels []string
+	Separator    string
+	Regex        *regexp.Regexp
+	TargetLabel  string
+	Replacement  string
+	Action       Action
+}
+
+// Compile a relabel config from JSON, filling in the Prometheus defaults.
+// Regular expressions are fully anchored.
+func New(c models.RelabelConfig) (*Config, error) {
+	cfg := &Config{
+		SourceLabels: c.SourceLabels,
+		Separator:    ";",
+		TargetLabel:  c.TargetLabel,
+		Replacement:  "$1",
+		Action:       Action(strings.ToLower(c.Action)),
+	}
+	if c.Separator != nil {
+		cfg.Separator = *c.Separator
+	}
+	if c.Replacement != nil {
+		cfg.Replacement = *c.Replacement
+	}
+	if cfg.Action == "" {
+		cfg.Action = Replace
+	}
+
+	regex := "(.*)"
+	if c.Regex != nil {
+		regex = *c.Regex
+	}
+	re, err := regexp.Compile("^(?s:" + regex + ")$")
+	if err != nil {
+		return nil, fmt.Errorf("invalid regex %q: %w", regex, err)
+	}
+	cfg.Regex = re
+
+	switch cfg.Action {
+	case Replace:
+		if cfg.TargetLabel == "" {
+			return nil, fmt.Errorf("relabel action %v requires target_label", cfg.Action)
+		}
+		if !targetLabelRegexp.MatchString(cfg.TargetLabel) {
+			return nil, fmt.Errorf("invalid target_label %q", cfg.TargetLabel)
+		}
+	case Keep, Drop:
+		if len(cfg.SourceLabels) == 0 {
+			return nil, fmt.Errorf("relabel action %v requires source_labels", cfg.Action)
+		}
+	case LabelDrop, LabelKeep:
+		if len(cfg.SourceLabels) > 0 || cfg.TargetLabel != "" {
+			return nil, fmt.Errorf("relabel action %v only uses regex", cfg.Action)
+		}
+	default:
+		return nil, fmt.Errorf("unsupported relabel action %q", c.Action)
+	}
+	return cfg, nil
+}
+
+// Compile a list of relabel configs
+func NewConfigs(configs []models.RelabelConfig) ([]*Config, error) {
+	var cfgs []*Config
+	for i, c := range configs {
+		cfg, err := New(c)
+		if err != nil {
+			return nil, fmt.Errorf("relabel config %d: %w", i, err)
+		}
+		cfgs = append(cfgs, cfg)
+	}
+	return cfgs, nil
+}
+
+// Apply the configs in order to the labels, which are changed in place.
+// Returns false if the series should be dropped. Labels set to an empty value
+// are removed and target labels expanding to an invalid name are skipped, the
+// same as in Prometheus.
+func Process(labels map[string]string, cfgs []*Config) bool {
+	for _, cfg := range cfgs {
+		if !cfg.apply(labels) {
+			return false
+		}
+	}
+	return true
+}
+
+func (cfg *Config) apply(labels map[string]string) bool {
+	values := make([]string, len(cfg.SourceLabels))
+	for i, name := range cfg.SourceLabels {
+		values[i] = labels[name]
+	}
+	val := strings.Join(values, cfg.Separator)
+
+	switch cfg.Action {
+	case Keep:
+		return cfg.Regex.MatchString(val)
+	case Drop:
+		return !cfg.Regex.MatchString(val)
+	case LabelDrop:
+		for name := range labels {
+			if cfg.Regex.MatchString(name) {
+				delete(labels, name)
+			}
+		}
+	case LabelKeep:
+		for name := range labels {
+			if name != MetricName && !cfg.Regex.MatchString(name) {
+				delete(labels, name)
+			}
+		}
+	case Replace:
+		indexes := cfg.Regex.FindStringSubmatchIndex(val)
+		if indexes == nil {
+			return true
+		}
+		target := string(cfg.Regex.ExpandString(nil, cfg.TargetLabel, val, indexes))
+		res := string(cfg.Regex.ExpandString(nil, cfg.Replacement, val, indexes))
+		if !ValidLabelName(target) {
+			return true
+		}
+		if res == "" {
+			delete(labels, target)
+		} else {
+			labels[target] = res
+		}
+	}
+	return true
+}
@@ -0,0 +1,97 @@
+package relabel
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/insikl/prometheus-nats-ambassador/internal/models"
+)
+
+func ptr(s string) *string { return &s }
+
+// Test relabel actions against a label set
+func TestProcess(t *testing.T) {
+	cfgs, err := NewConfigs([]models.RelabelConfig{
+		{SourceLabels: []string{"__name__"}, Regex: ptr("go_.*"), Action: "drop"},
+		{SourceLabels: []string{"device"}, Regex: ptr("(sd[a-z]+)[0-9]*"), TargetLabel: "disk"},
+		{Regex: ptr("device|job"), Action: "labeldrop"},
+		{SourceLabels: []string{"mode"}, Regex: ptr("idle|"), Action: "drop"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		in   map[string]string
+		want map[string]string
+	}{
+		{
+			in:   map[string]string{"__name__": "go_goroutines"},
+			want: nil,
+		},
+		{
+			in:   map[string]string{"__name__": "node_disk_reads", "device": "sda1", "job": "x", "mode": "user"},
+			want: map[string]string{"__name__": "node_disk_reads", "disk": "sda", "mode": "user"},
+		},
+		{
+			in:   map[string]string{"__name__": "node_cpu_seconds_total", "mode": "idle"},
+			want: nil,
+		},
+		{
+			in:   map[string]string{"__name__": "node_load1"},
+			want: nil,
+		},
+	}
+	for _, tt := range tests {
+		keep := Process(tt.in, cfgs)
+		if tt.want == nil {
+			if keep {
+				t.Errorf("expected drop, got %v", tt.in)
+			}
+			continue
+		}
+		if !keep || !reflect.DeepEqual(tt.in, tt.want) {
+			t.Errorf("got %v %v, want %v", keep, tt.in, tt.want)
+		}
+	}
+}
+
+// Test invalid configs are rejected
+func TestNewInvalid(t *testing.T) {
+	for _, c := range []models.RelabelConfig{
+		{Action: "hashmod"},
+		{Action: "replace"},
+		{Action: "keep"},
+		{Action: "labeldrop", SourceLabels: []string{"a"}},
+		{Action: "drop", SourceLabels: []string{"a"}, Regex: ptr("(")},
+		{TargetLabel: "0bad"},
+		{TargetLabel: "dc-1"},
+		{TargetLabel: "a.b"},
+		{TargetLabel: "$"},
+	} {
+		if _, err := New(c); err == nil {
+			t.Errorf("expected error for %+v", c)
+		}
+	}
+}
+
+// Test target labels expanding to an invalid name leave the labels alone
+func TestProcessInvalidTarget(t *testing.T) {
+	cfgs, err := NewConfigs([]models.RelabelConfig{
+		{SourceLabels: []string{"key"}, Regex: ptr("(.*)=(.*)"), TargetLabel: "${1}", Replacement: ptr("$2")},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for in, want := range map[string]map[string]string{
+		"site=dc1":  {"key": "site=dc1", "site": "dc1"},
+		"dc-1=x":    {"key": "dc-1=x"},
+		"1site=dc1": {"key": "1site=dc1"},
+		"=dc1":      {"key": "=dc1"},
+	} {
+		labels := map[string]string{"key": in}
+		if !Process(labels, cfgs) || !reflect.DeepEqual(labels, want) {
+			t.Errorf("%q: got %v, want %v", in, labels, want)
+		}
+	}
+}
@@ -0,0 +1,513 @@
+// Size capped on-disk FIFO queue of messages, kept in segment files with a
+// cursor file for the read position so a restart picks up where it left off.
+// Records and the cursor are synced to disk before Append and Commit return.
+// Delivery is at least once, a record read but not committed before a crash is
+// read again.
+//
+// Each record is stored as
+//
+//	length uint32 | crc32c uint32 | unix nano int64 | subject | headers | data
+//
+// with the CRC over everything after it. A torn record at the end of the last
+// segment, from a crash in the middle of a write, is cut off on open.
+package spool
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Returned by Peek when there is nothing to read
+var ErrEmpty = errors.New("spool is empty")
+
+const (
+	segmentExt  = ".seg"
+	cursorFile  = "cursor"
+	frameHeader = 8
+)
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// One spooled message
+type Record struct {
+	Time    time.Time
+	Subject string
+	Header  map[string][]string
+	Data    []byte
+}
+
+// Last segment being written, an `*os.File` outside of tests
+type segmentFile interface {
+	io.Writer
+	Sync() error
+	Truncate(size int64) error
+	Close() error
+}
+
+type segment struct {
+	id   uint64
+	size int64
+}
+
+// On-disk queue, safe for concurrent use
+type Spool struct {
+	dir          string
+	maxBytes     int64
+	segmentBytes int64
+
+	mu       sync.Mutex
+	segments []*segment // oldest first, records are appended to the last
+	w        segmentFile
+	cursor   segment // read position, id and offset
+
+	// Record at the cursor and its size on disk, set by Peek
+	next     *Record
+	nextSize int64
+
+	dropped int64
+}
+
+// Open or create a spool in dir. Once the segments add up to more than
+// maxBytes the oldest one is dropped, read or not.
+func Open(dir string, maxBytes, segmentBytes int64) (*Spool, error) {
+	if segmentBytes <= 0 || segmentBytes >= maxBytes {
+		return nil, fmt.Errorf("segment size %d must be between 0 and the spool size %d", segmentBytes, maxBytes)
+	}
+	if err := os.MkdirAll(dir, 0o750); err != nil {
+		return nil, err
+	}
+	s := &Spool{dir: dir, maxBytes: maxBytes, segmentBytes: segmentBytes}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasSuffix(name, segmentExt) {
+			continue
+		}
+		id, err := strconv.ParseUint(strings.TrimSuffix(name, segmentExt), 10, 64)
+		if err != nil {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return nil, err
+		}
+		s.segments = append(s.segments, &segment{id: id, size: info.Size()})
+	}
+	sort.Slice(s.segments, func(i, j int) bool { return s.segments[i].id < s.segments[j].id })
+
+	if err := s.loadCursor(); err != nil {
+		return nil, err
+	}
+
+	// Segments before the cursor were read already
+	for len(s.segments) > 0 && s.segments[0].id < s.cursor.id {
+		if err := os.Remove(s.path(s.segments[0].id)); err != nil {
+			return nil, err
+		}
+		s.segments = s.segments[1:]
+	}
+	if len(s.segments) == 0 || s.segments[0].id > s.cursor.id {
+		s.cursor = segment{}
+		if len(s.segments) > 0 {
+			s.cursor.id = s.segments[0].id
+		}
+	}
+
+	if len(s.segments) == 0 {
+		id := max(s.cursor.id, 1)
+		s.segments = append(s.segments, &segment{id: id})
+		s.cursor.id = id
+	} else if err := s.repairLast(); err != nil {
+		return nil, err
+	}
+
+	last := s.segments[len(s.segments)-1]
+	w, err := os.OpenFile(s.path(last.id), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o640)
+	if err != nil {
+		return nil, err
+	}
+	s.w = w
+	return s, s.saveCursor()
+}
+
+func (s *Spool) path(id uint64) string {
+	return filepath.Join(s.dir, fmt.Sprintf("%020d%s", id, segmentExt))
+}
+
+func (s *Spool) loadCursor() error {
+	b, err := os.ReadFile(filepath.Join(s.dir, cursorFile))
+	if errors.Is(err, os.ErrNotExist) {
+		if len(s.segments) > 0 {
+			s.cursor.id = s.segments[0].id
+		}
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if _, err := fmt.Sscanf(string(b), "%d %d", &s.cursor.id, &s.cursor.size); err != nil {
+		return fmt.Errorf("invalid spool cursor: %w", err)
+	}
+	return nil
+}
+
+// Write the cursor to a temp file and rename it over the old one, so a crash
+// leaves either the old or the new position
+func (s *Spool) saveCursor() error {
+	tmp := filepath.Join(s.dir, cursorFile+".tmp")
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o640)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(f, "%d %d\n", s.cursor.id, s.cursor.size)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, filepath.Join(s.dir, cursorFile)); err != nil {
+		return err
+	}
+	return s.syncDir()
+}
+
+// Sync the directory so created, renamed and removed files stick
+func (s *Spool) syncDir() error {
+	d, err := os.Open(s.dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// Cut the last segment after its last complete record
+func (s *Spool) repairLast() error {
+	last := s.segments[len(s.segments)-1]
+	f, err := os.OpenFile(s.path(last.id), os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var offset int64
+	for offset < last.size {
+		_, size, err := readRecord(f, offset, last.size)
+		if err != nil {
+			break
+		}
+		offset += size
+	}
+	if offset == last.size {
+		return nil
+	}
+	if err := f.Truncate(offset); err != nil {
+		return err
+	}
+	last.size = offset
+	if s.cursor.id == last.id && s.cursor.size > offset {
+		s.cursor.size = offset
+	}
+	return nil
+}
+
+// Add a record to the end of the spool
+func (s *Spool) Append(rec Record) error {
+	frame := encodeRecord(rec)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	last := s.segments[len(s.segments)-1]
+	if last.size > 0 && last.size+int64(len(frame)) > s.segmentBytes {
+		if err := s.w.Close(); err != nil {
+			return err
+		}
+		last = &segment{id: last.id + 1}
+		w, err := os.OpenFile(s.path(last.id), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o640)
+		if err != nil {
+			return err
+		}
+		s.w = w
+		s.segments = append(s.segments, last)
+		if err := s.syncDir(); err != nil {
+			return err
+		}
+	}
+
+	// Either the whole record is on disk or none of it, a torn frame would
+	// make every later record of the segment unreadable
+	n, err := s.w.Write(frame)
+	if err == nil {
+		err = s.w.Sync()
+	}
+	if err != nil {
+		if n > 0 {
+			if terr := s.w.Truncate(last.size); terr != nil {
+				return errors.Join(err, terr)
+			}
+		}
+		return err
+	}
+	last.size += int64(n)
+	return s.enforceCap()
+}
+
+// Drop the oldest segments while over the size cap
+func (s *Spool) enforceCap() error {
+	for len(s.segments) > 1 && s.total() > s.maxBytes {
+		oldest := s.segments[0]
+		if err := os.Remove(s.path(oldest.id)); err != nil {
+			return err
+		}
+		s.segments = s.segments[1:]
+		if s.cursor.id == oldest.id {
+			s.dropped += oldest.size - s.cursor.size
+			s.cursor = segment{id: s.segments[0].id}
+			s.next = nil
+			if err := s.saveCursor(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (s *Spool) total() int64 {
+	var total int64
+	for _, seg := range s.segments {
+		total += seg.size
+	}
+	return total
+}
+
+// Oldest record, without removing it. Returns ErrEmpty when there is none.
+func (s *Spool) Peek() (*Record, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.peek()
+}
+
+func (s *Spool) peek() (*Record, error) {
+	for s.next == nil {
+		seg := s.segments[0]
+		isLast := len(s.segments) == 1
+		if s.cursor.size >= seg.size {
+			if isLast {
+				return nil, ErrEmpty
+			}
+			if err := s.advance(); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		f, err := os.Open(s.path(seg.id))
+		if err != nil {
+			return nil, err
+		}
+		rec, size, err := readRecord(f, s.cursor.size, seg.size)
+		f.Close()
+		if err != nil {
+			// Corrupt, skip what is left of the segment
+			s.dropped += seg.size - s.cursor.size
+			s.cursor.size = seg.size
+			if err := s.saveCursor(); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		s.next, s.nextSize = rec, size
+	}
+	return s.next, nil
+}
+
+// Remove the fully read first segment and move the cursor to the next
+func (s *Spool) advance() error {
+	if err := os.Remove(s.path(s.segments[0].id)); err != nil {
+		return err
+	}
+	s.segments = s.segments[1:]
+	s.cursor = segment{id: s.segments[0].id}
+	return s.saveCursor()
+}
+
+// Remove the record returned by the last Peek
+func (s *Spool) Commit() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.next == nil {
+		return errors.New("nothing to commit")
+	}
+	s.cursor.size += s.nextSize
+	s.next = nil
+	if s.cursor.size >= s.segments[0].size && len(s.segments) > 1 {
+		return s.advance()
+	}
+	return s.saveCursor()
+}
+
+// Bytes on disk not read yet
+func (s *Spool) Bytes() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.total() - s.cursor.size
+}
+
+// Time the oldest record was added, zero when empty
+func (s *Spool) Oldest() time.Time {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	rec, err := s.peek()
+	if err != nil {
+		return time.Time{}
+	}
+	return rec.Time
+}
+
+// Bytes dropped for the size cap or corruption since open
+func (s *Spool) Dropped() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.dropped
+}
+
+// Close the spool, the read position is kept for the next Open
+func (s *Spool) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.w.Close(); err != nil {
+		return err
+	}
+	return s.saveCursor()
+}
+
+func appendString(b []byte, v string) []byte {
+	b = binary.AppendUvarint(b, uint64(len(v)))
+	return append(b, v...)
+}
+
+func encodeRecord(rec Record) []byte {
+	b := make([]byte, frameHeader, frameHeader+len(rec.Data)+256)
+	b = binary.BigEndian.AppendUint64(b, uint64(rec.Time.UnixNano()))
+	b = appendString(b, rec.Subject)
+	b = binary.AppendUvarint(b, uint64(len(rec.Header)))
+	for key, values := range rec.Header {
+		b = appendString(b, key)
+		b = binary.AppendUvarint(b, uint64(len(values)))
+		for _, v := range values {
+			b = appendString(b, v)
+		}
+	}
+	b = append(b, rec.Data...)
+
+	payload := b[frameHeader:]
+	binary.BigEndian.PutUint32(b[0:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(b[4:8], crc32.Checksum(payload, crcTable))
+	return b
+}
+
+var errCorrupt = errors.New("corrupt spool record")
+
+// Read the record at offset of a segment of the given size, returns it with
+// its size on disk
+func readRecord(r io.ReaderAt, offset, size int64) (*Record, int64, error) {
+	var header [frameHeader]byte
+	if offset+frameHeader > size {
+		return nil, 0, io.ErrUnexpectedEOF
+	}
+	if _, err := r.ReadAt(header[:], offset); err != nil {
+		return nil, 0, err
+	}
+	length := int64(binary.BigEndian.Uint32(header[0:4]))
+	if offset+frameHeader+length > size {
+		return nil, 0, io.ErrUnexpectedEOF
+	}
+	payload := make([]byte, length)
+	if _, err := r.ReadAt(payload, offset+frameHeader); err != nil {
+		return nil, 0, err
+	}
+	if crc32.Checksum(payload, crcTable) != binary.BigEndian.Uint32(header[4:8]) {
+		return nil, 0, errCorrupt
+	}
+
+	d := decoder{b: payload}
+	rec := &Record{}
+	rec.Time = time.Unix(0, int64(d.uint64()))
+	rec.Subject = d.string()
+	if n := d.uvarint(); n > 0 && d.err == nil {
+		rec.Header = make(map[string][]string, min(n, 64))
+		for i := uint64(0); i < n && d.err == nil; i++ {
+			key := d.string()
+			m := d.uvarint()
+			values := make([]string, 0, min(m, 64))
+			for j := uint64(0); j < m && d.err == nil; j++ {
+				values = append(values, d.string())
+			}
+			rec.Header[key] = values
+		}
+	}
+	if d.err != nil {
+		return nil, 0, d.err
+	}
+	rec.Data = d.b
+	return rec, frameHeader + int64(len(payload)), nil
+}
+
+// Reads the fields of a record payload, the first error sticks
+type decoder struct {
+	b   []byte
+	err error
+}
+
+func (d *decoder) uint64() uint64 {
+	if d.err != nil || len(d.b) < 8 {
+		d.err = errCorrupt
+		return 0
+	}
+	v := binary.BigEndian.Uint64(d.b)
+	d.b = d.b[8:]
+	return v
+}
+
+func (d *decoder) uvarint() uint64 {
+	if d.err != nil {
+		return 0
+	}
+	v, n := binary.Uvarint(d.b)
+	if n <= 0 {
+		d.err = errCorrupt
+		return 0
+	}
+	d.b = d.b[n:]
+	return v
+}
+
+func (d *decoder) string() string {
+	n := d.uvarint()
+	if d.err != nil || uint64(len(d.b)) < n {
+		d.err = errCorrupt
+		return ""
+	}
+	v := string(d.b[:n])
+	d.b = d.b[n:]
+	return v
+}
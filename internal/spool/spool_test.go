@@ -0,0 +1,158 @@
+package spool
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func record(i int) Record {
+	return Record{
+		Time:    time.Unix(int64(i), 0),
+		Subject: fmt.Sprintf("rw.%d.encoding.snappy", i),
+		Header:  map[string][]string{"Content-Type": {"application/x-protobuf"}},
+		Data:    []byte(fmt.Sprintf("payload %d", i)),
+	}
+}
+
+// Read and commit the next record, checking it is number i
+func expect(t *testing.T, s *Spool, i int) {
+	t.Helper()
+	rec, err := s.Peek()
+	if err != nil {
+		t.Fatalf("record %d: %v", i, err)
+	}
+	want := record(i)
+	if rec.Subject != want.Subject || string(rec.Data) != string(want.Data) ||
+		!rec.Time.Equal(want.Time) || rec.Header["Content-Type"][0] != "application/x-protobuf" {
+		t.Fatalf("got %+v, want %+v", rec, want)
+	}
+	if err := s.Commit(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Test records come back in order across segments and restarts
+func TestSpoolReplay(t *testing.T) {
+	dir := t.TempDir()
+	s, err := Open(dir, 1<<20, 128)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Peek(); !errors.Is(err, ErrEmpty) {
+		t.Fatalf("expected empty spool, got %v", err)
+	}
+	for i := 0; i < 10; i++ {
+		if err := s.Append(record(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !s.Oldest().Equal(time.Unix(0, 0)) {
+		t.Errorf("unexpected oldest %v", s.Oldest())
+	}
+	for i := 0; i < 4; i++ {
+		expect(t, s, i)
+	}
+	// Read but not committed, comes back after a restart
+	if _, err := s.Peek(); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Torn write at the end of the last segment
+	segs, _ := filepath.Glob(filepath.Join(dir, "*"+segmentExt))
+	f, err := os.OpenFile(segs[len(segs)-1], os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write(encodeRecord(record(99))[:12])
+	f.Close()
+
+	s, err = Open(dir, 1<<20, 128)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 4; i < 10; i++ {
+		expect(t, s, i)
+	}
+	if _, err := s.Peek(); !errors.Is(err, ErrEmpty) || s.Bytes() != 0 {
+		t.Fatalf("expected empty spool, got %v with %d bytes", err, s.Bytes())
+	}
+	if err := s.Append(record(10)); err != nil {
+		t.Fatal(err)
+	}
+	expect(t, s, 10)
+	s.Close()
+}
+
+// Test the oldest segments are dropped over the size cap
+func TestSpoolCap(t *testing.T) {
+	s, err := Open(t.TempDir(), 400, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	for i := 0; i < 40; i++ {
+		if err := s.Append(record(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if s.Bytes() > 400 || s.Dropped() == 0 {
+		t.Errorf("expected cap of 400 bytes, got %d with %d dropped", s.Bytes(), s.Dropped())
+	}
+	rec, err := s.Peek()
+	if err != nil || rec.Subject == record(0).Subject {
+		t.Errorf("expected oldest records dropped, got %v %v", rec, err)
+	}
+
+	if _, err := Open(t.TempDir(), 100, 100); err == nil {
+		t.Error("expected error for segment size not below spool size")
+	}
+}
+
+// Segment file failing after writing part of a record, like a full disk
+type shortWriter struct {
+	segmentFile
+	limit int
+}
+
+func (w *shortWriter) Write(b []byte) (int, error) {
+	if len(b) <= w.limit {
+		return w.segmentFile.Write(b)
+	}
+	n, _ := w.segmentFile.Write(b[:w.limit])
+	return n, errors.New("no space left on device")
+}
+
+// Test a failed write leaves no torn record behind
+func TestSpoolShortWrite(t *testing.T) {
+	s, err := Open(t.TempDir(), 1<<20, 1<<16)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if err := s.Append(record(0)); err != nil {
+		t.Fatal(err)
+	}
+
+	file := s.w
+	s.w = &shortWriter{segmentFile: file, limit: 10}
+	if err := s.Append(record(1)); err == nil {
+		t.Fatal("expected write error")
+	}
+	s.w = file
+
+	if err := s.Append(record(2)); err != nil {
+		t.Fatal(err)
+	}
+	expect(t, s, 0)
+	expect(t, s, 2)
+	if s.Dropped() != 0 {
+		t.Errorf("expected nothing dropped as corrupt, got %d bytes", s.Dropped())
+	}
+}